@@ -0,0 +1,256 @@
+package api
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/control"
+	"anti-abuse-go/history"
+	"anti-abuse-go/logger"
+)
+
+//go:embed dashboard.html
+var dashboard []byte
+
+type access int
+
+const (
+	accessNone access = iota
+	accessRead
+	accessOperator
+)
+
+// Server is the HTTP API and dashboard. Commands go through the control
+// socket handlers so the API and "sentinel ctl" behave the same.
+type Server struct {
+	srv           *http.Server
+	ctl           *control.Server
+	records       *history.Store
+	readToken     []byte
+	operatorToken []byte
+}
+
+// Start serves the API when enabled in the config. It returns nil when the
+// API is disabled.
+func Start(cfg *config.Config, ctl *control.Server, records *history.Store) *Server {
+	if !cfg.API.Enabled {
+		return nil
+	}
+
+	listen := "127.0.0.1:9110"
+	if cfg.API.Listen != "" {
+		listen = cfg.API.Listen
+	}
+	s := &Server{
+		ctl:           ctl,
+		records:       records,
+		readToken:     []byte(cfg.API.ReadToken),
+		operatorToken: []byte(cfg.API.OperatorToken),
+	}
+	s.srv = &http.Server{Addr: listen, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+
+	scheme := "http"
+	if cfg.API.TLSCert != "" {
+		scheme = "https"
+	}
+	go func() {
+		var err error
+		if scheme == "https" {
+			err = s.srv.ListenAndServeTLS(cfg.API.TLSCert, cfg.API.TLSKey)
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Log.WithError(err).Error("API server failed")
+		}
+	}()
+	logger.Log.Infof("API and dashboard available at %s://%s/", scheme, listen)
+	return s
+}
+
+func (s *Server) Stop() {
+	if s == nil {
+		return
+	}
+	_ = s.srv.Close()
+}
+
+// ServeHTTP routes requests. The dashboard page itself holds no data and is
+// served without a token; every /api/ endpoint requires one.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Path == "/" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		_, _ = w.Write(dashboard)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	level := s.authorize(r)
+	if level == accessNone {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sentinel"`)
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "status":
+		s.command(w, "status")
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "detections":
+		s.command(w, "detections", r.URL.Query().Get("limit"))
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "history":
+		s.history(w, r, r.URL.Query().Get("server"))
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "servers" && parts[2] == "history":
+		s.history(w, r, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "rules":
+		s.command(w, "rules")
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "quarantine":
+		s.command(w, "quarantine", "list")
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "scan":
+		if !requireOperator(w, level) {
+			return
+		}
+		var body struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil || !strings.HasPrefix(body.Path, "/") {
+			writeError(w, http.StatusBadRequest, `expected {"path": "/absolute/path"}`)
+			return
+		}
+		// Only watched paths, scanned in the background; results show up
+		// in detections and history
+		logger.Log.Infof("API rescan of %s requested from %s", body.Path, r.RemoteAddr)
+		data, err := s.ctl.Run("scan-watched", []string{body.Path})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, data)
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[0] == "quarantine" && parts[2] == "restore":
+		if !requireOperator(w, level) {
+			return
+		}
+		logger.Log.Infof("API release of quarantine item %s requested from %s", parts[1], r.RemoteAddr)
+		s.command(w, "quarantine", "restore", parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// authorize checks the bearer token in constant time.
+func (s *Server) authorize(r *http.Request) access {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return accessNone
+	}
+	if len(s.operatorToken) > 0 && subtle.ConstantTimeCompare([]byte(token), s.operatorToken) == 1 {
+		return accessOperator
+	}
+	if len(s.readToken) > 0 && subtle.ConstantTimeCompare([]byte(token), s.readToken) == 1 {
+		return accessRead
+	}
+	return accessNone
+}
+
+func requireOperator(w http.ResponseWriter, level access) bool {
+	if level < accessOperator {
+		writeError(w, http.StatusForbidden, "operator token required")
+		return false
+	}
+	return true
+}
+
+// command runs a control command and replies with its result.
+func (s *Server) command(w http.ResponseWriter, command string, args ...string) {
+	// Optional trailing arguments are left out rather than sent empty
+	for len(args) > 0 && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	data, err := s.ctl.Run(command, args)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, data)
+}
+
+// history queries the detection history. Without from or since it covers
+// the last 7 days.
+func (s *Server) history(w http.ResponseWriter, r *http.Request, server string) {
+	params := r.URL.Query()
+	q := history.Query{
+		Server: server,
+		Rule:   params.Get("rule"),
+		Hash:   params.Get("hash"),
+		Limit:  100,
+		From:   time.Now().AddDate(0, 0, -7),
+	}
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		q.Limit = n
+	}
+	if v := params.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+		q.From = time.Now().Add(-d)
+	}
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s, expected RFC3339", name))
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	records, err := s.records.Find(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if records == nil {
+		records = []*history.Record{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if data == nil {
+		data = map[string]bool{"ok": true}
+	}
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"anti-abuse-go/logger"
+	"anti-abuse-go/scanner"
+	"anti-abuse-go/updater"
+)
+
+// runBundleCommand creates signing keys and signed rule bundles for
+// UPDATES. It runs on the machine that publishes rules, not on the agents.
+func runBundleCommand(args []string) {
+	usage := "Usage: sentinel bundle keygen <name> | build -key <name.key> -version <version> [-out dir] <rules dir>"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		public, private, err := updater.GenerateKey()
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Failed to generate key")
+		}
+		if err := os.WriteFile(args[1]+".key", []byte(private+"\n"), 0600); err != nil {
+			logger.Log.WithError(err).Fatal("Failed to write private key")
+		}
+		if err := os.WriteFile(args[1]+".pub", []byte(public+"\n"), 0644); err != nil {
+			logger.Log.WithError(err).Fatal("Failed to write public key")
+		}
+		fmt.Printf("Wrote %s.key (keep it off the agents) and %s.pub\n", args[1], args[1])
+		fmt.Printf("Set UPDATES.public_key = %q on the agents\n", public)
+	case "build":
+		fs := flag.NewFlagSet("bundle build", flag.ExitOnError)
+		keyFile := fs.String("key", "", "Private key file from \"sentinel bundle keygen\"")
+		version := fs.String("version", "", "Bundle version, e.g. 2024.06.01")
+		out := fs.String("out", ".", "Directory to write the bundle, manifest and signature to")
+		fs.Parse(args[1:])
+		if *keyFile == "" || *version == "" || fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+
+		keyData, err := os.ReadFile(*keyFile)
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Failed to read private key")
+		}
+		key, err := updater.ParsePrivateKey(string(keyData))
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Invalid private key")
+		}
+		// Agents reject bundles that do not compile; catch that before publishing
+		rules, err := scanner.CheckRules(fs.Arg(0))
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Rules do not compile")
+		}
+		m, err := updater.Build(fs.Arg(0), *out, *version, rules, key)
+		if err != nil {
+			logger.Log.WithError(err).Fatal("Failed to build bundle")
+		}
+		fmt.Printf("Built bundle %s (%d rules, %d bytes) in %s\n", m.Version, m.Rules, m.Size, *out)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
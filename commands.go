@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/daemon"
+	"anti-abuse-go/integrations"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/outbox"
+)
+
+func runCommand(args []string) {
+	switch args[0] {
+	case "outbox":
+		runOutboxCommand(args[1:])
+	case "attachment":
+		runAttachmentCommand(args[1:])
+	case "reload":
+		runReloadCommand()
+	case "ctl":
+		runCtlCommand(args[1:])
+	case "history":
+		runHistoryCommand(args[1:])
+	case "server":
+		runFleetServer()
+	case "bundle":
+		runBundleCommand(args[1:])
+	case "test-rules":
+		runTestRulesCommand(args[1:])
+	case "scan":
+		runScanCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func loadConfigOrExit() *config.Config {
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to load config")
+	}
+	return cfg
+}
+
+// runReloadCommand validates the config file and signals the running
+// instance to apply it, so mistakes are reported here rather than only in
+// the daemon log.
+func runReloadCommand() {
+	if err := loadConfigOrExit().Validate(); err != nil {
+		logger.Log.WithError(err).Fatal("Config is invalid, not reloading")
+	}
+	if err := daemon.Reload(); err != nil {
+		logger.Log.WithError(err).Fatal("Failed to reload")
+	}
+	fmt.Println("Reload requested, see the daemon log for the result")
+}
+
+func runOutboxCommand(args []string) {
+	usage := "Usage: sentinel outbox list [pending|dead] | retry <id|all> | purge [pending|dead]"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// States name outbox directories, so only the known ones are accepted
+	if (args[0] == "list" || args[0] == "purge") && len(args) > 1 && args[1] != outbox.StatePending && args[1] != outbox.StateDead {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	box, err := outbox.Open(loadConfigOrExit())
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to open outbox")
+	}
+
+	switch args[0] {
+	case "list":
+		states := []string{outbox.StatePending, outbox.StateDead}
+		if len(args) > 1 {
+			states = []string{args[1]}
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATE\tID\tKIND\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+		for _, state := range states {
+			entries, err := box.List(state)
+			if err != nil {
+				logger.Log.WithError(err).Fatalf("Failed to list %s entries", state)
+			}
+			for _, e := range entries {
+				next := e.NextAttempt.Format(time.RFC3339)
+				if state == outbox.StateDead {
+					next = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", state, e.ID, e.Kind, e.Attempts, next, e.LastError)
+			}
+		}
+		tw.Flush()
+	case "retry":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if args[1] == "all" {
+			n, err := box.RetryAll()
+			if err != nil {
+				logger.Log.WithError(err).Fatal("Failed to retry dead letters")
+			}
+			fmt.Printf("Requeued %d deliveries\n", n)
+			return
+		}
+		if err := box.Retry(args[1]); err != nil {
+			logger.Log.WithError(err).Fatal("Failed to retry delivery")
+		}
+		fmt.Printf("Requeued %s\n", args[1])
+	case "purge":
+		state := outbox.StateDead
+		if len(args) > 1 {
+			state = args[1]
+		}
+		n, err := box.Purge(state)
+		if err != nil {
+			logger.Log.WithError(err).Fatalf("Failed to purge %s entries", state)
+		}
+		fmt.Printf("Removed %d %s deliveries\n", n, state)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func runAttachmentCommand(args []string) {
+	if len(args) != 3 || args[0] != "decrypt" {
+		fmt.Fprintln(os.Stderr, "Usage: sentinel attachment decrypt <file.zip.enc> <output.zip>")
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to read attachment")
+	}
+	plain, err := integrations.DecryptAttachment(loadConfigOrExit(), data)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to decrypt attachment")
+	}
+	if err := os.WriteFile(args[2], plain, 0600); err != nil {
+		logger.Log.WithError(err).Fatal("Failed to write output")
+	}
+	fmt.Printf("Decrypted to %s\n", args[2])
+}
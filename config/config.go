@@ -36,19 +36,223 @@ SignaturePath = "/etc/sentinel/signatures"
 watchdogIgnorePath = ["/etc/sentinel/signatures"]
 watchdogIgnoreFile = ["main.go", "config.toml"]
 maxFileSizeMB = 500  # Allow up to 500MB files
+# Compiled rules are cached here and reused while the rule files are unchanged.
+# Precompiled .yarc files in SignaturePath are loaded as-is. "none" disables the cache.
+ruleCachePath = "/var/lib/sentinel/rule-cache"
+# Subdirectories of SignaturePath are loaded recursively; each directory is its own
+# namespace, each top-level file too. Rule files with errors are skipped and listed
+# by "sentinel ctl rules-report"; with strictRules they fail startup and reloads.
+strictRules = false
+
+# Scan profiles per watch root or glob pattern; the first matching profile applies and
+# files matching none use the defaults below. Unset limits default to a 30s timeout,
+# maxFileSizeMB, 10MB per archive entry and 5 nested archive levels (-1 scans archives
+# as plain files). namespaces limits the scan to the rules in those namespaces.
+# [[DETECTION.PROFILES]]
+# name = "ssh"
+# paths = ["/root/.ssh", "/home/*/.ssh"]
+# timeout_seconds = 5
+# max_file_size_mb = 1
+# archive_depth = -1
+# namespaces = ["credentials"]
+# fast_mode = true
+# disable_ai = true
+
+[DETECTION.HEURISTICS]
+# Checks next to YARA for packed and encrypted executables. Matches are named
+# heuristic:packer_<name> (UPX, MPRESS, ASPack, ...) and heuristic:high_entropy_elf, and
+# belong to the "heuristic" namespace for DETECTION.PROFILES.
+enabled = false
+# ELF files outside trusted_paths with a loaded section above this Shannon entropy
+# (bits per byte, 8 is random) are flagged. Empty trusted_paths means the system
+# binary and library directories (/bin, /sbin, /usr, /lib*, /opt, /snap, /nix/store).
+entropy_threshold = 7.2
+min_section_kb = 4
+trusted_paths = []
+# Packed game binaries are common, so heuristic matches only alert by default; with
+# "high" the default high-severity decision rule suspends on a heuristic alone.
+severity = "medium"
+
+[DETECTION.PROFILING]
+# Time spent per YARA rule, shown by "sentinel ctl slow-rules" and in METRICS.
+# Needs libyara built with --enable-profiling; adds a little overhead per scan.
+enabled = false
+top = 20
+# Rules taking longer than budget_ms in one scan are logged, or with
+# action = "disable" switched off until the next rules reload. 0 disables the check.
+budget_ms = 0
+action = "warn"
+
+[UPDATES]
+# Signed rule bundles. When enabled, the active bundle replaces SignaturePath
+# and is hot-swapped after it is verified and test-compiled.
+enabled = false
+# Leave url empty to fetch bundles from the fleet server (FLEET.server_url)
+url = ""
+public_key = ""
+interval_minutes = 60
+keep = 3
+path = "/var/lib/sentinel/bundles"
 
 [INTEGRATION.AI]
 enabled = false
-generate_models = ["llama-3.3-70b-versatile", "llama-3.3-70b-specdec"]
-generate_endpoint = "http://localhost:11434/api/generate"
-use_groq = false
-groq_api_token = ""
-prompt = "Analyze the given code and return an abuse score (0-10) with a brief reason. Example abuses: Crypto Mining, Shell Access, Nezha Proxy (VPN/Proxy usage), Disk Filling, Tor, DDoS, Abusive Resource Usage. Response format: '**5/10** <your reason>'. No extra messages."
+# Prompt template. Available fields: {{.FilePath}}, {{.Rules}}, {{.Excerpt}}.
+# The model must reply with JSON: {"score": 0-10, "category": "...", "reason": "...", "confidence": 0.0-1.0};
+# free-text replies like "**5/10** reason" are still accepted as a fallback.
+prompt = """
+You are a malware analyst reviewing a file flagged on a game server host.
+File: {{.FilePath}}
+Matched YARA rules: {{.Rules}}
+
+Rate how likely this file is abusive. Example abuses: Crypto Mining, Shell Access, Nezha Proxy (VPN/Proxy usage), Disk Filling, Tor, DDoS, Abusive Resource Usage.
+Respond with only a JSON object, no extra text:
+{"score": <integer 0-10>, "category": "<crypto-mining|shell-access|proxy|disk-filling|tor|ddos|resource-abuse|credential-theft|malware|benign|other>", "reason": "<one sentence>", "confidence": <number 0.0-1.0>}
+
+Content:
+{{.Excerpt}}"""
+
+# Large files are reduced before analysis (binaries to strings, archives to text entries and
+# class constants, big text files to windows around matches) and split into chunks.
+chunk_tokens = 3000
+max_chunks = 4
+# Analyses run in the background. "followup" sends the alert right away and the verdict
+# as a follow-up message, "wait" holds the alert until the verdict arrives. Detections
+# the decision rules ignore are not alerted in either mode.
+alert_mode = "followup"
+concurrency = 2
+queue_size = 32
+# Provider requests per hour; every chunk and fallback model attempt counts
+max_requests_per_hour = 0  # 0 = unlimited
+# Verdicts are cached by content hash and prompt version
+cache_ttl_minutes = 1440
+cache_entries = 10000
+
+# Providers are tried in order, each model in turn, until one answers.
+# type is "openai" (any OpenAI-compatible endpoint: vLLM, LM Studio, llama.cpp server), "ollama" or "groq".
+[[INTEGRATION.AI.providers]]
+name = "local-ollama"
+type = "ollama"
+base_url = "http://localhost:11434"
+models = ["llama3.1"]
+timeout_seconds = 30
+max_tokens = 512
+json_mode = true
+
+[[INTEGRATION.AI.providers]]
+name = "groq"
+type = "groq"
+api_key = ""
+models = ["llama-3.3-70b-versatile", "llama-3.3-70b-specdec"]
+timeout_seconds = 30
+max_tokens = 512
+max_input_tokens = 6000
+
+[INTEGRATION.ALERTS]
+# Detections for the same server within this window are sent as one alert
+window_seconds = 30
+max_detections_per_alert = 10
 
 [INTEGRATION.DISCORD]
 enabled = false
 webhook_url = "https://discord.com/api/webhooks/YOUR_WEBHOOK_ID/YOUR_WEBHOOK_TOKEN"
 truncate_text = true
+rate_limit_per_minute = 20
+# What to attach to alerts: "none", "hashes", "excerpt" (redacted context around matches)
+# or "encrypted" (zip of the flagged files sealed with attachment_key). Raw files are never sent.
+attachment = "hashes"
+excerpt_bytes = 256
+attachment_max_mb = 8
+# 64 hex characters, e.g. from: openssl rand -hex 32
+attachment_key = ""
+
+[INTEGRATION.REDACTION]
+# Secrets matching these patterns are masked before anything leaves the host
+disable_default_patterns = false
+patterns = []
+
+[DECISION]
+# Decides what happens to a detection. Rules are checked in order and the first one whose
+# conditions all hold wins; detections matching no rule get default_action.
+# Actions: "ignore", "alert", "quarantine", "suspend". Severity comes from the YARA rule's severity meta or tag.
+# Upgrade note: earlier versions suspended on every match. With these rules, YARA rules
+# without a severity meta or tag only alert; give them severity = "high" to keep suspending.
+default_action = "alert"
+hash_blocklist = ""  # File with one SHA256 per line
+
+[[DECISION.rules]]
+name = "hash-blocklist"
+action = "suspend"
+hash_listed = true
+
+[[DECISION.rules]]
+name = "high-severity"
+action = "suspend"
+min_severity = "high"
+
+[[DECISION.rules]]
+name = "ai-confident"
+action = "suspend"
+min_ai_score = 8
+min_ai_confidence = 0.7
+
+[OUTBOX]
+# Failed notifications and plugin actions are retried from here with exponential backoff
+path = "/var/lib/sentinel/outbox"
+max_attempts = 10
+base_delay_seconds = 5
+max_delay_seconds = 3600
+
+[METRICS]
+# Prometheus endpoint with scan, detection, notifier, plugin and AI metrics
+enabled = false
+listen = "127.0.0.1:9108"
+path = "/metrics"
+
+[API]
+# HTTP API and dashboard (open http://<listen>/ in a browser)
+enabled = false
+listen = "127.0.0.1:9110"
+# Tokens are sent as "Authorization: Bearer <token>"; use long random values
+read_token = ""
+operator_token = ""
+tls_cert = ""
+tls_key = ""
+
+[FLEET]
+# Send every decided detection to a central "sentinel server". Deliveries go
+# through the outbox, so they are buffered while the server is unreachable.
+# Must be https:// unless the server is on loopback.
+server_url = ""
+token = ""
+ca_file = ""
+
+[FLEET.SERVER]
+# Only used when this binary runs as "sentinel server"
+listen = ":9120"
+tls_cert = "/etc/sentinel/fleet.crt"
+tls_key = "/etc/sentinel/fleet.key"
+data_path = "/var/lib/sentinel/fleet"
+retention_days = 90
+query_token = ""
+# Directory holding manifest.json, manifest.json.sig and the bundle for agents
+bundle_path = "/var/lib/sentinel/fleet-bundles"
+
+[FLEET.SERVER.agents]
+# machineID = "token", one long random token per node
+# node1 = ""
+
+[QUARANTINE]
+# Files moved aside by the "quarantine" action or "sentinel ctl quarantine add"
+path = "/var/lib/sentinel/quarantine"
+
+[HISTORY]
+# Detection log queried with "sentinel history", one file per day
+path = "/var/lib/sentinel/history"
+retention_days = 90
+
+[CONTROL]
+# Unix socket used by "sentinel ctl", reachable by root only
+socket = "/var/run/sentinel/sentinel.sock"
 
 [PLUGINS.PterodactylAutoSuspend]
 enabled = false
@@ -75,24 +279,133 @@ type Config struct {
 		WatchdogIgnorePath []string `toml:"watchdogIgnorePath"`
 		WatchdogIgnoreFile []string `toml:"watchdogIgnoreFile"`
 		MaxFileSizeMB      int      `toml:"maxFileSizeMB"` // Optional, default 100MB
+		RuleCachePath      string   `toml:"ruleCachePath"` // Optional, default /var/lib/sentinel/rule-cache, "none" to disable
+		StrictRules        bool     `toml:"strictRules"`   // Optional, fail startup and reloads on any rule error instead of skipping the file
+
+		Profiles []ScanProfile `toml:"PROFILES"`
+
+		Profiling struct {
+			Enabled  bool   `toml:"enabled"`
+			Top      int    `toml:"top"`       // Optional, slow rules in metrics and "ctl slow-rules", default 20
+			BudgetMs int    `toml:"budget_ms"` // Optional, time one rule may use in a single scan, 0 for no limit
+			Action   string `toml:"action"`    // Optional, warn (default) or disable the rule until the next rules reload
+		} `toml:"PROFILING"`
+
+		Heuristics struct {
+			Enabled          bool     `toml:"enabled"`
+			EntropyThreshold float64  `toml:"entropy_threshold"` // Optional, bits per byte, default 7.2
+			MinSectionKB     int      `toml:"min_section_kb"`    // Optional, smaller sections are not measured, default 4
+			TrustedPaths     []string `toml:"trusted_paths"`     // Optional, where high-entropy ELF files are expected, default the system directories
+			Severity         string   `toml:"severity"`          // Optional, severity of heuristic matches, default medium
+		} `toml:"HEURISTICS"`
 	} `toml:"DETECTION"`
 
+	Updates struct {
+		Enabled         bool   `toml:"enabled"`
+		URL             string `toml:"url"`              // Base URL of manifest.json, manifest.json.sig and the bundle; empty to use the fleet server
+		PublicKey       string `toml:"public_key"`       // Hex ed25519 key that signs the manifests
+		IntervalMinutes int    `toml:"interval_minutes"` // Optional, default 60
+		Keep            int    `toml:"keep"`             // Optional, previous bundles kept for rollback, default 3
+		Path            string `toml:"path"`             // Optional, default /var/lib/sentinel/bundles
+	} `toml:"UPDATES"`
+
 	Integration struct {
 		AI struct {
-			Enabled          bool     `toml:"enabled"`
-			GenerateModels   []string `toml:"generate_models"`
-			GenerateEndpoint string   `toml:"generate_endpoint"`
-			UseGroq          bool     `toml:"use_groq"`
-			GroqAPIKey       string   `toml:"groq_api_token"`
-			Prompt           string   `toml:"prompt"`
+			Enabled            bool         `toml:"enabled"`
+			GenerateModels     []string     `toml:"generate_models"`   // Legacy, used when no providers are set
+			GenerateEndpoint   string       `toml:"generate_endpoint"` // Legacy, used when no providers are set
+			UseGroq            bool         `toml:"use_groq"`          // Legacy, used when no providers are set
+			GroqAPIKey         string       `toml:"groq_api_token"`    // Legacy, used when no providers are set
+			Prompt             string       `toml:"prompt"`
+			ChunkTokens        int          `toml:"chunk_tokens"`          // Optional, default 3000
+			MaxChunks          int          `toml:"max_chunks"`            // Optional, default 4
+			AlertMode          string       `toml:"alert_mode"`            // followup (default) or wait
+			Concurrency        int          `toml:"concurrency"`           // Optional, default 2
+			QueueSize          int          `toml:"queue_size"`            // Optional, default 32
+			MaxRequestsPerHour int          `toml:"max_requests_per_hour"` // Optional, provider requests per hour, 0 = unlimited
+			CacheTTLMinutes    int          `toml:"cache_ttl_minutes"`     // Optional, default 1440
+			CacheEntries       int          `toml:"cache_entries"`         // Optional, default 10000
+			Providers          []AIProvider `toml:"providers"`             // Tried in order until one answers
 		} `toml:"AI"`
+		Alerts struct {
+			WindowSeconds         int `toml:"window_seconds"`           // Optional, default 30
+			MaxDetectionsPerAlert int `toml:"max_detections_per_alert"` // Optional, default 10
+		} `toml:"ALERTS"`
 		Discord struct {
-			Enabled      bool   `toml:"enabled"`
-			WebhookURL   string `toml:"webhook_url"`
-			TruncateText bool   `toml:"truncate_text"`
+			Enabled            bool   `toml:"enabled"`
+			WebhookURL         string `toml:"webhook_url"`
+			TruncateText       bool   `toml:"truncate_text"`
+			RateLimitPerMinute int    `toml:"rate_limit_per_minute"` // Optional, default 20
+			Attachment         string `toml:"attachment"`            // none, hashes (default), excerpt, encrypted
+			ExcerptBytes       int    `toml:"excerpt_bytes"`         // Optional, default 256
+			AttachmentMaxMB    int    `toml:"attachment_max_mb"`     // Optional, default 8
+			AttachmentKey      string `toml:"attachment_key"`        // Hex-encoded AES-256 key for encrypted attachments
 		} `toml:"DISCORD"`
+		Redaction struct {
+			DisableDefaultPatterns bool     `toml:"disable_default_patterns"`
+			Patterns               []string `toml:"patterns"`
+		} `toml:"REDACTION"`
 	} `toml:"INTEGRATION"`
 
+	Decision struct {
+		DefaultAction string         `toml:"default_action"` // Optional, default alert
+		HashBlocklist string         `toml:"hash_blocklist"` // File of SHA256 hashes, one per line
+		Rules         []DecisionRule `toml:"rules"`          // Evaluated in order, the first match wins
+	} `toml:"DECISION"`
+
+	Outbox struct {
+		Path             string `toml:"path"`               // Optional, default /var/lib/sentinel/outbox
+		MaxAttempts      int    `toml:"max_attempts"`       // Optional, default 10
+		BaseDelaySeconds int    `toml:"base_delay_seconds"` // Optional, default 5
+		MaxDelaySeconds  int    `toml:"max_delay_seconds"`  // Optional, default 3600
+	} `toml:"OUTBOX"`
+
+	Metrics struct {
+		Enabled bool   `toml:"enabled"`
+		Listen  string `toml:"listen"` // Optional, default 127.0.0.1:9108
+		Path    string `toml:"path"`   // Optional, default /metrics
+	} `toml:"METRICS"`
+
+	API struct {
+		Enabled       bool   `toml:"enabled"`
+		Listen        string `toml:"listen"`         // Optional, default 127.0.0.1:9110
+		ReadToken     string `toml:"read_token"`     // Bearer token for the read-only endpoints
+		OperatorToken string `toml:"operator_token"` // Bearer token that may also rescan and release from quarantine
+		TLSCert       string `toml:"tls_cert"`       // Optional, serve HTTPS with this certificate
+		TLSKey        string `toml:"tls_key"`
+	} `toml:"API"`
+
+	Fleet struct {
+		ServerURL string `toml:"server_url"` // Send detections to this fleet server, empty to disable
+		Token     string `toml:"token"`      // Token the fleet server knows this machine by
+		CAFile    string `toml:"ca_file"`    // Optional, CA certificate for a self-signed fleet server
+
+		// Used by "sentinel server"
+		Server struct {
+			Listen        string            `toml:"listen"`   // Optional, default :9120
+			TLSCert       string            `toml:"tls_cert"` // Required unless listening on loopback behind a TLS proxy
+			TLSKey        string            `toml:"tls_key"`
+			DataPath      string            `toml:"data_path"`      // Optional, default /var/lib/sentinel/fleet
+			RetentionDays int               `toml:"retention_days"` // Optional, default 90
+			QueryToken    string            `toml:"query_token"`    // Bearer token for the query API
+			BundlePath    string            `toml:"bundle_path"`    // Optional, signature bundles served to agents
+			Agents        map[string]string `toml:"agents"`         // machineID = token
+		} `toml:"SERVER"`
+	} `toml:"FLEET"`
+
+	Quarantine struct {
+		Path string `toml:"path"` // Optional, default /var/lib/sentinel/quarantine
+	} `toml:"QUARANTINE"`
+
+	History struct {
+		Path          string `toml:"path"`           // Optional, default /var/lib/sentinel/history
+		RetentionDays int    `toml:"retention_days"` // Optional, default 90
+	} `toml:"HISTORY"`
+
+	Control struct {
+		Socket string `toml:"socket"` // Optional, default /var/run/sentinel/sentinel.sock
+	} `toml:"CONTROL"`
+
 	Plugins struct {
 		PterodactylAutoSuspend struct {
 			Enabled  bool   `toml:"enabled"`
@@ -102,6 +415,45 @@ type Config struct {
 	} `toml:"PLUGINS"`
 }
 
+// AIProvider is one entry of the AI fallback chain.
+type AIProvider struct {
+	Name           string   `toml:"name"`
+	Type           string   `toml:"type"` // openai, ollama, groq
+	BaseURL        string   `toml:"base_url"`
+	APIKey         string   `toml:"api_key"`
+	Models         []string `toml:"models"`
+	TimeoutSeconds int      `toml:"timeout_seconds"`  // Optional, default 30
+	MaxTokens      int      `toml:"max_tokens"`       // Optional, default 512
+	MaxInputTokens int      `toml:"max_input_tokens"` // Optional, prompt is truncated to fit
+	Temperature    float64  `toml:"temperature"`      // Optional, default 0.1
+	JSONMode       bool     `toml:"json_mode"`        // Ask the endpoint to force a JSON reply, if supported
+}
+
+// DecisionRule maps detection inputs to an action. All conditions that are
+// set must hold for the rule to match.
+type DecisionRule struct {
+	Name            string  `toml:"name"`
+	Action          string  `toml:"action"`            // ignore, alert, quarantine, suspend
+	MinSeverity     string  `toml:"min_severity"`      // low, medium, high, critical
+	MinAIScore      int     `toml:"min_ai_score"`      // 0-10
+	MinAIConfidence float64 `toml:"min_ai_confidence"` // 0.0-1.0
+	HashListed      bool    `toml:"hash_listed"`       // SHA256 is in the hash blocklist
+}
+
+// ScanProfile sets how files under some paths are scanned. The first profile
+// with a matching path applies.
+type ScanProfile struct {
+	Name           string   `toml:"name"`
+	Paths          []string `toml:"paths"`             // Watch roots or glob patterns; patterns without a slash match the file name
+	TimeoutSeconds int      `toml:"timeout_seconds"`   // Optional, YARA timeout per file, default 30
+	MaxFileSizeMB  int      `toml:"max_file_size_mb"`  // Optional, default DETECTION.maxFileSizeMB
+	MaxEntrySizeMB int      `toml:"max_entry_size_mb"` // Optional, per archive entry, default 10
+	ArchiveDepth   int      `toml:"archive_depth"`     // Optional, nested archive levels opened, default 5, -1 for none
+	Namespaces     []string `toml:"namespaces"`        // Optional, only rules in these namespaces run
+	FastMode       bool     `toml:"fast_mode"`         // Stop at the first match of each string
+	DisableAI      bool     `toml:"disable_ai"`        // Skip AI analysis of detections
+}
+
 func LoadConfig(path string) (*Config, error) {
 	// Create config directory if it doesn't exist
 	configDir := filepath.Dir(path)
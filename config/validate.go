@@ -0,0 +1,184 @@
+package config
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Validate checks the settings that would otherwise only fail once an
+// event is processed. All problems are reported together.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Detection.MaxFileSizeMB < 0 {
+		add("DETECTION.maxFileSizeMB must not be negative")
+	}
+	for _, root := range c.Detection.WatchdogPath {
+		if strings.TrimSpace(root) == "" {
+			add("DETECTION.watchdogPath contains an empty path")
+		}
+	}
+	for _, pattern := range append(append([]string{}, c.Detection.WatchdogIgnorePath...), c.Detection.WatchdogIgnoreFile...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			add("invalid ignore pattern %q: %v", pattern, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, p := range c.Detection.Profiles {
+		switch {
+		case p.Name == "":
+			add("DETECTION.PROFILES[%d] needs a name", i)
+		case names[p.Name]:
+			add("DETECTION.PROFILES: duplicate name %q", p.Name)
+		}
+		names[p.Name] = true
+		for _, pattern := range p.Paths {
+			if _, err := filepath.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+				add("DETECTION.PROFILES[%d]: invalid path %q", i, pattern)
+			}
+		}
+		if p.TimeoutSeconds < 0 || p.MaxFileSizeMB < 0 || p.MaxEntrySizeMB < 0 {
+			add("DETECTION.PROFILES[%d]: timeout_seconds, max_file_size_mb and max_entry_size_mb must not be negative", i)
+		}
+		if p.ArchiveDepth < -1 {
+			add("DETECTION.PROFILES[%d]: archive_depth must be -1 or more", i)
+		}
+	}
+
+	heuristics := c.Detection.Heuristics
+	if heuristics.EntropyThreshold < 0 || heuristics.EntropyThreshold > 8 {
+		add("DETECTION.HEURISTICS.entropy_threshold must be between 0 and 8")
+	}
+	switch heuristics.Severity {
+	case "", "low", "medium", "high", "critical":
+	default:
+		add("DETECTION.HEURISTICS.severity must be low, medium, high or critical, got %q", heuristics.Severity)
+	}
+	if heuristics.MinSectionKB < 0 {
+		add("DETECTION.HEURISTICS.min_section_kb must not be negative")
+	}
+	for _, pattern := range heuristics.TrustedPaths {
+		if _, err := filepath.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			add("DETECTION.HEURISTICS: invalid trusted path %q", pattern)
+		}
+	}
+
+	profiling := c.Detection.Profiling
+	switch profiling.Action {
+	case "", "warn", "disable":
+	default:
+		add("DETECTION.PROFILING.action must be warn or disable, got %q", profiling.Action)
+	}
+	if profiling.BudgetMs < 0 || profiling.Top < 0 {
+		add("DETECTION.PROFILING.budget_ms and top must not be negative")
+	}
+
+	if updates := c.Updates; updates.Enabled {
+		if key, err := hex.DecodeString(updates.PublicKey); err != nil || len(key) != 32 {
+			add("UPDATES.public_key must be 64 hex characters")
+		}
+		if updates.URL == "" && c.Fleet.ServerURL == "" {
+			add("UPDATES needs url or FLEET.server_url")
+		}
+		if updates.URL != "" {
+			if u, err := url.ParseRequestURI(updates.URL); err != nil || u.Host == "" {
+				add("UPDATES.url must be a valid URL")
+			}
+		}
+	}
+
+	ai := c.Integration.AI
+	switch ai.AlertMode {
+	case "", "followup", "wait":
+	default:
+		add("INTEGRATION.AI.alert_mode must be followup or wait, got %q", ai.AlertMode)
+	}
+	for i, p := range ai.Providers {
+		switch strings.ToLower(p.Type) {
+		case "", "openai", "groq", "ollama":
+		default:
+			add("INTEGRATION.AI.providers[%d]: unknown type %q", i, p.Type)
+		}
+		if p.BaseURL != "" {
+			if _, err := url.ParseRequestURI(p.BaseURL); err != nil {
+				add("INTEGRATION.AI.providers[%d]: invalid base_url: %v", i, err)
+			}
+		}
+	}
+
+	discord := c.Integration.Discord
+	if discord.Enabled {
+		if u, err := url.ParseRequestURI(discord.WebhookURL); err != nil || u.Host == "" {
+			add("INTEGRATION.DISCORD.webhook_url must be a valid URL when Discord is enabled")
+		}
+	}
+	switch discord.Attachment {
+	case "", "none", "hashes", "excerpt":
+	case "encrypted":
+		if key, err := hex.DecodeString(discord.AttachmentKey); err != nil || len(key) != 32 {
+			add("INTEGRATION.DISCORD.attachment_key must be 64 hex characters for encrypted attachments")
+		}
+	default:
+		add("INTEGRATION.DISCORD.attachment must be none, hashes, excerpt or encrypted, got %q", discord.Attachment)
+	}
+
+	for _, pattern := range c.Integration.Redaction.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			add("invalid redaction pattern %q: %v", pattern, err)
+		}
+	}
+
+	api := c.API
+	if api.Enabled {
+		if api.ReadToken == "" && api.OperatorToken == "" {
+			add("API needs read_token or operator_token when enabled")
+		}
+		for name, token := range map[string]string{"read_token": api.ReadToken, "operator_token": api.OperatorToken} {
+			if token != "" && len(token) < 16 {
+				add("API.%s must be at least 16 characters", name)
+			}
+		}
+		if api.ReadToken != "" && api.ReadToken == api.OperatorToken {
+			add("API.read_token and API.operator_token must differ")
+		}
+		if (api.TLSCert == "") != (api.TLSKey == "") {
+			add("API.tls_cert and API.tls_key must be set together")
+		}
+	}
+
+	if fleet := c.Fleet; fleet.ServerURL != "" {
+		// The fleet token travels with every request, so plain http is only
+		// accepted for a server on the same machine
+		u, err := url.ParseRequestURI(fleet.ServerURL)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && (u.Scheme != "http" || !isLoopbackHost(u.Hostname()))) {
+			add("FLEET.server_url must be an https:// URL, or http:// on loopback")
+		}
+		if fleet.Token == "" {
+			add("FLEET.token is required when server_url is set")
+		}
+		if c.MachineID == "" {
+			add("machineID is required when FLEET.server_url is set")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isLoopbackHost reports whether host is localhost or a loopback address.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
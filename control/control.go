@@ -0,0 +1,186 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+const DefaultSocket = "/var/run/sentinel/sentinel.sock"
+
+// Request is a single command sent over the control socket.
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Response carries the command result or its error.
+type Response struct {
+	OK    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// Handler runs a command. The returned value is sent back as JSON.
+type Handler func(args []string) (interface{}, error)
+
+// Server answers one JSON request per connection on a Unix socket that only
+// root can reach.
+type Server struct {
+	path     string
+	listener net.Listener
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+
+	wg sync.WaitGroup
+}
+
+// SocketPath returns the configured control socket path.
+func SocketPath(cfg *config.Config) string {
+	if cfg.Control.Socket != "" {
+		return cfg.Control.Socket
+	}
+	return DefaultSocket
+}
+
+func NewServer(cfg *config.Config) *Server {
+	return &Server{
+		path:     SocketPath(cfg),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle registers the handler for a command.
+func (s *Server) Handle(command string, h Handler) {
+	s.mu.Lock()
+	s.handlers[command] = h
+	s.mu.Unlock()
+}
+
+// Commands lists the registered commands.
+func (s *Server) Commands() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	commands := make([]string, 0, len(s.handlers))
+	for command := range s.handlers {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// Start listens on the socket. A leftover socket from a previous run is
+// replaced; the pidfile lock guarantees no other instance owns it.
+func (s *Server) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	_ = os.Remove(s.path)
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.path, err)
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+	logger.Log.Infof("Control socket listening on %s", s.path)
+	return nil
+}
+
+func (s *Server) Stop() {
+	if s.listener == nil {
+		return
+	}
+	s.listener.Close()
+	s.wg.Wait()
+	_ = os.Remove(s.path)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var req Request
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		writeResponse(conn, nil, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	data, err := s.Run(req.Command, req.Args)
+	writeResponse(conn, data, err)
+}
+
+// Run runs a command in process, the same way as one received on the socket.
+func (s *Server) Run(command string, args []string) (interface{}, error) {
+	s.mu.RLock()
+	h, ok := s.handlers[command]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", command)
+	}
+
+	logger.Log.Debugf("Control command: %s %v", command, args)
+	return h(args)
+}
+
+func writeResponse(conn net.Conn, data interface{}, err error) {
+	resp := Response{OK: err == nil}
+	if err != nil {
+		resp.Error = err.Error()
+	} else if data != nil {
+		raw, merr := json.Marshal(data)
+		if merr != nil {
+			resp = Response{Error: merr.Error()}
+		} else {
+			resp.Data = raw
+		}
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// Call sends a command to the daemon and returns the raw result.
+func Call(socket, command string, args ...string) (json.RawMessage, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach daemon at %s: %w", socket, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(Request{Command: command, Args: args}); err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid response from daemon: %w", err)
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp.Data, nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/control"
+	"anti-abuse-go/integrations"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/quarantine"
+	"anti-abuse-go/scanner"
+	"anti-abuse-go/updater"
+	"anti-abuse-go/watcher"
+)
+
+// daemonStatus is the reply to the status command.
+type daemonStatus struct {
+	Version string         `json:"version"`
+	PID     int            `json:"pid"`
+	Started time.Time      `json:"started"`
+	Uptime  string         `json:"uptime"`
+	Watcher watcher.Status `json:"watcher"`
+}
+
+// bundleUpdate is the reply to the update-rules command.
+type bundleUpdate struct {
+	Manifest  *updater.Manifest `json:"manifest"`
+	Installed bool              `json:"installed"`
+}
+
+// registerControlCommands wires the control socket commands to the daemon.
+func registerControlCommands(ctl *control.Server, st *runtimeState, store *quarantine.Store) {
+	ctl.Handle("status", func(args []string) (interface{}, error) {
+		return daemonStatus{
+			Version: config.GetVersion(),
+			PID:     os.Getpid(),
+			Started: st.started,
+			Uptime:  time.Since(st.started).Round(time.Second).String(),
+			Watcher: st.watch.Status(),
+		}, nil
+	})
+	ctl.Handle("reload-config", func(args []string) (interface{}, error) {
+		return nil, st.reloadConfig()
+	})
+	ctl.Handle("reload-rules", func(args []string) (interface{}, error) {
+		if err := st.reloadRules(); err != nil {
+			return nil, err
+		}
+		return map[string]int{"rules_loaded": st.scan.RuleCount()}, nil
+	})
+	ctl.Handle("rules", func(args []string) (interface{}, error) {
+		return st.scan.Rules(), nil
+	})
+	ctl.Handle("rules-report", func(args []string) (interface{}, error) {
+		return st.scan.Report(), nil
+	})
+	ctl.Handle("slow-rules", func(args []string) (interface{}, error) {
+		n := profilingTop(st.config())
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				return nil, fmt.Errorf("invalid count %q", args[0])
+			}
+		}
+		return st.scan.SlowRules(n), nil
+	})
+	ctl.Handle("bundles", func(args []string) (interface{}, error) {
+		return st.updates.List()
+	})
+	ctl.Handle("update-rules", func(args []string) (interface{}, error) {
+		m, installed, err := st.updates.Check(true)
+		if err != nil {
+			return nil, err
+		}
+		return bundleUpdate{Manifest: m, Installed: installed}, nil
+	})
+	ctl.Handle("rollback-rules", func(args []string) (interface{}, error) {
+		version := ""
+		if len(args) > 0 {
+			version = args[0]
+		}
+		return st.updates.Rollback(version)
+	})
+	ctl.Handle("scan", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: scan <path>")
+		}
+		return st.watch.ScanPath(args[0])
+	})
+	ctl.Handle("scan-watched", func(args []string) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: scan-watched <path>")
+		}
+		path, err := st.watch.StartScan(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"path": path, "status": "started"}, nil
+	})
+	ctl.Handle("pause", func(args []string) (interface{}, error) {
+		st.watch.Pause()
+		return nil, nil
+	})
+	ctl.Handle("resume", func(args []string) (interface{}, error) {
+		st.watch.Resume()
+		return nil, nil
+	})
+	ctl.Handle("detections", func(args []string) (interface{}, error) {
+		n := 20
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				return nil, fmt.Errorf("invalid count %q", args[0])
+			}
+		}
+		return st.watch.RecentDetections(n), nil
+	})
+	ctl.Handle("quarantine", func(args []string) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("usage: quarantine list | add <path> | restore <id> | delete <id>")
+		}
+		switch {
+		case args[0] == "list":
+			return store.List()
+		case args[0] == "add" && len(args) == 2:
+			return store.Add(args[1], "manual", "")
+		case args[0] == "restore" && len(args) == 2:
+			return store.Restore(args[1])
+		case args[0] == "delete" && len(args) == 2:
+			return nil, store.Delete(args[1])
+		default:
+			return nil, fmt.Errorf("usage: quarantine list | add <path> | restore <id> | delete <id>")
+		}
+	})
+}
+
+// runCtlCommand sends a command to the running daemon over the control socket.
+func runCtlCommand(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the raw JSON reply")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sentinel ctl [-json] <command> [args]")
+		fmt.Fprintln(os.Stderr, "Commands: status, reload-config, reload-rules, rules, rules-report, slow-rules [n], scan <path>,")
+		fmt.Fprintln(os.Stderr, "          scan-watched <path>, pause, resume, detections [n], quarantine list|add <path>|restore <id>|delete <id>,")
+		fmt.Fprintln(os.Stderr, "          bundles, update-rules, rollback-rules [version]")
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	command, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	// The daemon runs from /, so paths are resolved here
+	if (command == "scan" && len(cmdArgs) == 1) || (command == "quarantine" && len(cmdArgs) == 2 && cmdArgs[0] == "add") {
+		last := len(cmdArgs) - 1
+		if abs, err := filepath.Abs(cmdArgs[last]); err == nil {
+			cmdArgs[last] = abs
+		}
+	}
+
+	data, err := control.Call(control.SocketPath(loadConfigOrExit()), command, cmdArgs...)
+	if err != nil {
+		logger.Log.WithError(err).Fatalf("%s failed", command)
+	}
+
+	if *asJSON {
+		if len(data) > 0 {
+			fmt.Println(string(data))
+		}
+		return
+	}
+	if err := printCtlResult(command, cmdArgs, data); err != nil {
+		logger.Log.WithError(err).Fatal("Failed to read reply")
+	}
+}
+
+func printCtlResult(command string, args []string, data json.RawMessage) error {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	switch command {
+	case "status":
+		var s daemonStatus
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		w := s.Watcher
+		fmt.Fprintf(tw, "Version:\t%s\n", s.Version)
+		fmt.Fprintf(tw, "PID:\t%d\n", s.PID)
+		fmt.Fprintf(tw, "Uptime:\t%s (since %s)\n", s.Uptime, s.Started.Format(time.RFC3339))
+		fmt.Fprintf(tw, "Paused:\t%t\n", w.Paused)
+		fmt.Fprintf(tw, "Workers:\t%d\n", w.Workers)
+		fmt.Fprintf(tw, "Queue:\t%d/%d\n", w.QueueDepth, w.QueueCapacity)
+		fmt.Fprintf(tw, "AI queue:\t%d\n", w.AIQueueDepth)
+		fmt.Fprintf(tw, "Watched dirs:\t%d\n", w.WatchedDirs)
+		fmt.Fprintf(tw, "Rules loaded:\t%d\n", w.RulesLoaded)
+	case "scan":
+		var r watcher.ScanReport
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		for _, f := range r.Flagged {
+			rules := make([]string, 0, len(f.Matches))
+			for _, m := range f.Matches {
+				rules = append(rules, m.Rule)
+			}
+			fmt.Fprintf(tw, "FLAGGED\t%s\t%s\n", f.Path, strings.Join(rules, ", "))
+		}
+		fmt.Fprintf(tw, "%d files scanned, %d flagged, %d errors\n", r.Files, len(r.Flagged), r.Errors)
+	case "detections":
+		var detections []integrations.Detection
+		if err := json.Unmarshal(data, &detections); err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "TIME\tACTION\tPATH\tRULES")
+		for _, d := range detections {
+			action := "-"
+			if d.Verdict != nil {
+				action = d.Verdict.Action
+			}
+			rules := make([]string, 0, len(d.Matches))
+			for _, m := range d.Matches {
+				rules = append(rules, m.Rule)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Time.Format(time.RFC3339), action, d.Path, strings.Join(rules, ", "))
+		}
+	case "quarantine":
+		switch args[0] {
+		case "list":
+			var items []quarantine.Item
+			if err := json.Unmarshal(data, &items); err != nil {
+				return err
+			}
+			fmt.Fprintln(tw, "ID\tQUARANTINED\tSIZE\tPATH\tREASON")
+			for _, item := range items {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", item.ID, item.QuarantinedAt.Format(time.RFC3339), item.Size, item.OriginalPath, item.Reason)
+			}
+		case "add", "restore":
+			var item quarantine.Item
+			if err := json.Unmarshal(data, &item); err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", item.ID, item.OriginalPath)
+		default:
+			fmt.Fprintln(tw, "OK")
+		}
+	case "rules":
+		var rules []scanner.RuleInfo
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "NAMESPACE\tRULE\tSEVERITY\tTAGS")
+		for _, r := range rules {
+			severity := r.Severity
+			if severity == "" {
+				severity = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.Namespace, r.Name, severity, strings.Join(r.Tags, ", "))
+		}
+	case "rules-report":
+		var r scanner.CompileReport
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		source := "compiled"
+		if r.Cached {
+			source = "from cache"
+		}
+		fmt.Fprintf(tw, "Loaded %d rules from %d files in %s (%s, %s)\n", r.Rules, r.Files, r.Path, source, r.Time.Format(time.RFC3339))
+		for _, m := range r.Errors {
+			fmt.Fprintf(tw, "ERROR\t%s\n", m)
+		}
+		for _, m := range r.Warnings {
+			fmt.Fprintf(tw, "WARNING\t%s\n", m)
+		}
+		fmt.Fprintf(tw, "%d files failed, %d errors, %d warnings\n", r.Failed, len(r.Errors), len(r.Warnings))
+	case "slow-rules":
+		var r scanner.ProfileReport
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if !r.Enabled {
+			fmt.Fprintln(tw, "Profiling is off, enable DETECTION.PROFILING")
+			return nil
+		}
+		if len(r.Rules) == 0 {
+			fmt.Fprintln(tw, "No rule costs recorded yet; they need libyara built with --enable-profiling")
+			return nil
+		}
+		fmt.Fprintln(tw, "NAMESPACE\tRULE\tTIME")
+		for _, c := range r.Rules {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", c.Namespace, c.Rule, c.Cost)
+		}
+		fmt.Fprintln(tw, "\nNAMESPACE\tTIME")
+		for _, c := range r.Namespaces {
+			fmt.Fprintf(tw, "%s\t%s\n", c.Namespace, c.Cost)
+		}
+		if len(r.OverBudget) > 0 {
+			fmt.Fprintf(tw, "\nOVER %s BUDGET\tSCANS\tMAX\tDISABLED\n", r.Budget)
+			for _, slow := range r.OverBudget {
+				fmt.Fprintf(tw, "%s:%s\t%d\t%s\t%t\n", slow.Namespace, slow.Rule, slow.Exceeded, slow.Max, slow.Disabled)
+			}
+		}
+	case "bundles":
+		var bundles []updater.Bundle
+		if err := json.Unmarshal(data, &bundles); err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "VERSION\tCREATED\tRULES\tACTIVE")
+		for _, b := range bundles {
+			active := ""
+			if b.Active {
+				active = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", b.Version, b.Created.Format(time.RFC3339), b.Rules, active)
+		}
+	case "update-rules":
+		var r bundleUpdate
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		if r.Installed {
+			fmt.Fprintf(tw, "Installed and activated bundle %s\n", r.Manifest.Version)
+		} else {
+			fmt.Fprintf(tw, "Bundle %s is not newer than the active one\n", r.Manifest.Version)
+		}
+	case "rollback-rules":
+		var m updater.Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "Rolled back to bundle %s, pinned until the next update-rules\n", m.Version)
+	case "reload-rules":
+		var r map[string]int
+		if err := json.Unmarshal(data, &r); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "Rules reloaded, %d loaded\n", r["rules_loaded"])
+	case "scan-watched":
+		var started map[string]string
+		if err := json.Unmarshal(data, &started); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "Scanning %s in the background\n", started["path"])
+	default:
+		fmt.Fprintln(tw, "OK")
+	}
+	return nil
+}
@@ -1,12 +1,15 @@
 package daemon
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"anti-abuse-go/logger"
 )
@@ -14,102 +17,283 @@ import (
 const (
 	PidFile = "/var/run/sentinel/sentinel.pid"
 	LogFile = "/var/log/sentinel/sentinel.log"
+
+	StopTimeout  = 30 * time.Second // Time given to a clean shutdown before SIGKILL
+	startTimeout = 5 * time.Second
 )
 
-func StartDaemon(binaryPath, configPath, logLevel string) error {
-	// Check if already running
-	if isRunning() {
-		return fmt.Errorf("daemon already running")
-	}
+// Exit codes of the status action, following the LSB init script conventions
+const (
+	StatusRunning       = 0
+	StatusDeadPidExists = 1
+	StatusNotRunning    = 3
+	StatusUnknown       = 4
+)
 
-	// Fork process
-	cmd := exec.Command(binaryPath, "--daemon", "--config", configPath, "--log-level", logLevel)
-	cmd.Stdout = nil
-	cmd.Stderr = nil
-	// Note: Setsid not available on Windows, use for Linux builds
-	// cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+var ErrRunning = errors.New("sentinel is already running")
 
-	if err := cmd.Start(); err != nil {
-		return err
+// Pid is the locked pidfile of the running instance. The lock is held for
+// the lifetime of the process, so a pidfile without a lock is stale.
+type Pid struct {
+	file *os.File
+}
+
+// AcquirePidFile creates and locks the pidfile for the current process.
+// It returns ErrRunning when another instance holds the lock.
+func AcquirePidFile() (*Pid, error) {
+	if err := os.MkdirAll(filepath.Dir(PidFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create pid directory: %w", err)
 	}
 
-	// Write PID
-	pidFile := getPidFile()
-	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
-		_ = cmd.Process.Kill()
-		return err
+	file, err := os.OpenFile(PidFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pidfile: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrRunning
+		}
+		return nil, fmt.Errorf("failed to lock pidfile: %w", err)
+	}
+	// A stale pidfile removed between the open and the lock leaves this
+	// lock on an unlinked file, so open it again
+	if current, err := os.Stat(PidFile); err != nil || !sameInode(file, current) {
+		file.Close()
+		return AcquirePidFile()
 	}
 
-	logger.Log.Infof("Daemon started with PID %d", cmd.Process.Pid)
-	return nil
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Pid{file: file}, nil
 }
 
-func StopDaemon() error {
-	pid, err := readPid()
-	if err != nil {
-		return err
+func sameInode(file *os.File, info os.FileInfo) bool {
+	opened, err := file.Stat()
+	return err == nil && os.SameFile(opened, info)
+}
+
+// Release removes the pidfile and drops the lock.
+func (p *Pid) Release() {
+	if p == nil {
+		return
+	}
+	_ = os.Remove(PidFile)
+	_ = p.file.Close()
+}
+
+// StartDaemon starts a detached instance in its own session and waits until
+// it holds the pidfile.
+func StartDaemon(binaryPath, configPath, logLevel string) error {
+	if pid, state := probe(); state == StatusRunning {
+		return fmt.Errorf("%w with PID %d", ErrRunning, pid)
 	}
 
-	process, err := os.FindProcess(pid)
+	absConfig, err := filepath.Abs(configPath)
 	if err != nil {
 		return err
 	}
 
-	if err := process.Kill(); err != nil {
+	// Stdio stays unset so the child gets /dev/null; logs go to LogFile
+	cmd := exec.Command(binaryPath, "--daemon", "--config", absConfig, "--log-level", logLevel)
+	cmd.Dir = "/"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
 		return err
 	}
 
-	_ = os.Remove(getPidFile())
-	logger.Log.Info("Daemon stopped")
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.After(startTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("daemon exited during startup (%v), see %s", err, LogFile)
+		case <-deadline:
+			return fmt.Errorf("daemon did not create %s within %s, see %s", PidFile, startTimeout, LogFile)
+		case <-ticker.C:
+			if pid, state := probe(); state == StatusRunning && pid == cmd.Process.Pid {
+				logger.Log.Infof("Daemon started with PID %d", pid)
+				return nil
+			}
+		}
+	}
+}
+
+// StopDaemon asks the running instance to shut down with SIGTERM and kills
+// it if it has not exited within the timeout.
+func StopDaemon(timeout time.Duration) error {
+	pid, state := probe()
+	switch state {
+	case StatusNotRunning:
+		return fmt.Errorf("daemon is not running")
+	case StatusDeadPidExists:
+		if err := removeStale(); err != nil {
+			return fmt.Errorf("daemon is not running, failed to remove stale pidfile: %w", err)
+		}
+		return fmt.Errorf("daemon is not running, removed stale pidfile for PID %d", pid)
+	case StatusUnknown:
+		return fmt.Errorf("cannot determine daemon state from %s (PID %d), its lock is held", PidFile, pid)
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to signal PID %d: %w", pid, err)
+	}
+	logger.Log.Infof("Sent SIGTERM to PID %d, waiting up to %s", pid, timeout)
+
+	if waitExit(pid, timeout) {
+		logger.Log.Info("Daemon stopped")
+		return nil
+	}
+
+	logger.Log.Warnf("PID %d did not exit within %s, sending SIGKILL", pid, timeout)
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("failed to kill PID %d: %w", pid, err)
+	}
+	waitExit(pid, 5*time.Second)
+	_ = removeStale()
+	logger.Log.Info("Daemon killed")
 	return nil
 }
 
 func RestartDaemon(binaryPath, configPath, logLevel string) error {
-	if err := StopDaemon(); err != nil {
-		return err
+	if _, state := probe(); state == StatusRunning {
+		if err := StopDaemon(StopTimeout); err != nil {
+			return err
+		}
 	}
 	return StartDaemon(binaryPath, configPath, logLevel)
 }
 
-func Status() error {
-	if isRunning() {
-		pid, _ := readPid()
+// Reload asks the running instance to re-read its configuration.
+func Reload() error {
+	pid, state := probe()
+	if state != StatusRunning {
+		return fmt.Errorf("daemon is not running")
+	}
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to signal PID %d: %w", pid, err)
+	}
+	return nil
+}
+
+// Status prints the daemon state and returns the matching LSB exit code.
+func Status() int {
+	pid, state := probe()
+	switch state {
+	case StatusRunning:
 		fmt.Printf("Daemon is running with PID %d\n", pid)
-	} else {
+	case StatusDeadPidExists:
+		fmt.Printf("Daemon is not running but %s exists (PID %d)\n", PidFile, pid)
+	case StatusNotRunning:
 		fmt.Println("Daemon is not running")
+	default:
+		fmt.Printf("Cannot determine daemon state from %s\n", PidFile)
 	}
-	return nil
+	return state
 }
 
-func isRunning() bool {
-	pid, err := readPid()
+// probe reports the PID in the pidfile and whether it is a live Sentinel
+// process. A running instance holds the pidfile lock, so a held lock is
+// never reported as dead: when the PID can't be read yet or doesn't look
+// like this binary, the state is unknown.
+func probe() (int, int) {
+	file, err := os.Open(PidFile)
+	if os.IsNotExist(err) {
+		return 0, StatusNotRunning
+	}
 	if err != nil {
-		return false
+		return 0, StatusUnknown
 	}
+	defer file.Close()
 
-	process, err := os.FindProcess(pid)
-	if err != nil {
-		return false
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		pid, _ := readPid(file)
+		return pid, StatusDeadPidExists
+	} else if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return 0, StatusUnknown
 	}
 
-	return process.Signal(syscall.Signal(0)) == nil
+	pid, err := readPid(file)
+	if err != nil || !isSentinel(pid) {
+		return pid, StatusUnknown
+	}
+	return pid, StatusRunning
 }
 
-func readPid() (int, error) {
-	pidFile := getPidFile()
-	data, err := os.ReadFile(pidFile)
+// removeStale removes the pidfile only while nobody holds its lock, so the
+// pidfile of a live instance is never deleted.
+func removeStale() error {
+	file, err := os.Open(PidFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return 0, err
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return ErrRunning
+		}
+		return err
 	}
+	return os.Remove(PidFile)
+}
 
-	pid, err := strconv.Atoi(string(data))
+func readPid(file *os.File) (int, error) {
+	data := make([]byte, 32)
+	n, err := file.Read(data)
 	if err != nil {
 		return 0, err
 	}
+	return strconv.Atoi(strings.TrimSpace(string(data[:n])))
+}
+
+// isSentinel checks that pid runs the same binary as this process, so a
+// recycled PID is never signalled.
+func isSentinel(pid int) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(self); err == nil {
+		self = resolved
+	}
+
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err == nil {
+		// The binary may have been replaced by an upgrade since the daemon started
+		return strings.TrimSuffix(exe, " (deleted)") == self
+	}
 
-	return pid, nil
+	// Without permission to read exe, fall back to the command line
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	argv0 := strings.SplitN(string(cmdline), "\x00", 2)[0]
+	return filepath.Base(argv0) == filepath.Base(self)
 }
 
-func getPidFile() string {
-	return filepath.Join(".", PidFile)
+// waitExit polls until pid has exited or the timeout passes.
+func waitExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
 }
@@ -0,0 +1,202 @@
+package decision
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/scanner"
+)
+
+// Actions a verdict can ask for, from least to most severe
+const (
+	ActionIgnore     = "ignore"
+	ActionAlert      = "alert"
+	ActionQuarantine = "quarantine" // Alert and move the file into quarantine
+	ActionSuspend    = "suspend"
+)
+
+var actions = map[string]bool{ActionIgnore: true, ActionAlert: true, ActionQuarantine: true, ActionSuspend: true}
+
+// Severity levels as set by the severity meta or tag of a YARA rule
+var severities = map[string]int{"low": 1, "medium": 2, "high": 3, "critical": 4}
+
+// Built-in rules used when DECISION.rules is empty
+var defaultRules = []config.DecisionRule{
+	{Name: "hash-blocklist", Action: ActionSuspend, HashListed: true},
+	{Name: "high-severity", Action: ActionSuspend, MinSeverity: "high"},
+	{Name: "ai-confident", Action: ActionSuspend, MinAIScore: 8, MinAIConfidence: 0.7},
+}
+
+// Input is what is known about a detection when it is decided.
+type Input struct {
+	SHA256  string
+	Matches scanner.MatchRules
+	AI      *AIInput // nil when there is no AI verdict
+}
+
+// AIInput is the part of an AI verdict the rules can use.
+type AIInput struct {
+	Score      int
+	Confidence float64
+}
+
+// Verdict is the final decision for a detection and the inputs that led to it.
+type Verdict struct {
+	Action     string   `json:"action"`
+	Rule       string   `json:"rule,omitempty"` // Decision rule that fired, empty for the default action
+	Severity   string   `json:"severity,omitempty"`
+	HashListed bool     `json:"hash_listed,omitempty"`
+	AIScore    int      `json:"ai_score,omitempty"`
+	Reasons    []string `json:"reasons"`
+}
+
+// Summary renders the verdict in one line for logs and alerts.
+func (v *Verdict) Summary() string {
+	if v.Rule != "" {
+		return fmt.Sprintf("%s by %s: %s", v.Action, v.Rule, strings.Join(v.Reasons, ", "))
+	}
+	return fmt.Sprintf("%s: %s", v.Action, strings.Join(v.Reasons, ", "))
+}
+
+// Engine evaluates the configured decision rules in order; the first rule
+// whose conditions all hold decides the action.
+type Engine struct {
+	rules         []config.DecisionRule
+	defaultAction string
+	blocklist     map[string]bool
+}
+
+func NewEngine(cfg *config.Config) (*Engine, error) {
+	e := &Engine{
+		rules:         cfg.Decision.Rules,
+		defaultAction: ActionAlert,
+		blocklist:     make(map[string]bool),
+	}
+	if len(e.rules) == 0 {
+		e.rules = defaultRules
+	}
+	if cfg.Decision.DefaultAction != "" {
+		e.defaultAction = strings.ToLower(cfg.Decision.DefaultAction)
+	}
+	if !actions[e.defaultAction] {
+		return nil, fmt.Errorf("unknown default decision action %q", cfg.Decision.DefaultAction)
+	}
+
+	for i, rule := range e.rules {
+		if !actions[strings.ToLower(rule.Action)] {
+			return nil, fmt.Errorf("decision rule %d (%s): unknown action %q", i+1, rule.Name, rule.Action)
+		}
+		if rule.MinSeverity != "" && severities[strings.ToLower(rule.MinSeverity)] == 0 {
+			return nil, fmt.Errorf("decision rule %d (%s): unknown severity %q", i+1, rule.Name, rule.MinSeverity)
+		}
+	}
+
+	if cfg.Decision.HashBlocklist != "" {
+		if err := e.loadBlocklist(cfg.Decision.HashBlocklist); err != nil {
+			logger.Log.WithError(err).Warnf("Failed to load hash blocklist %s", cfg.Decision.HashBlocklist)
+		}
+	}
+	return e, nil
+}
+
+// loadBlocklist reads SHA256 hashes, one per line. Anything after the hash
+// on a line and lines starting with # are ignored.
+func (e *Engine) loadBlocklist(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields[0]) == 64 {
+			e.blocklist[strings.ToLower(fields[0])] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	logger.Log.Infof("Loaded %d hashes from blocklist %s", len(e.blocklist), path)
+	return nil
+}
+
+// Decide returns the verdict for a detection.
+func (e *Engine) Decide(in Input) *Verdict {
+	severity, severityRule := maxSeverity(in.Matches)
+	listed := e.blocklist[strings.ToLower(in.SHA256)]
+
+	verdict := &Verdict{Action: e.defaultAction, Severity: severity, HashListed: listed}
+	if in.AI != nil {
+		verdict.AIScore = in.AI.Score
+	}
+
+	for _, rule := range e.rules {
+		reasons, ok := evaluate(rule, severity, severityRule, listed, in.AI)
+		if !ok {
+			continue
+		}
+		verdict.Action = strings.ToLower(rule.Action)
+		verdict.Rule = rule.Name
+		verdict.Reasons = reasons
+		return verdict
+	}
+
+	verdict.Reasons = []string{"no decision rule matched"}
+	return verdict
+}
+
+// evaluate checks every condition set on a rule and describes the ones that
+// held. A rule without conditions always matches.
+func evaluate(rule config.DecisionRule, severity, severityRule string, listed bool, ai *AIInput) ([]string, bool) {
+	var reasons []string
+	if rule.HashListed {
+		if !listed {
+			return nil, false
+		}
+		reasons = append(reasons, "sha256 in hash blocklist")
+	}
+	if rule.MinSeverity != "" {
+		min := strings.ToLower(rule.MinSeverity)
+		if severities[severity] < severities[min] {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("severity %s >= %s (%s)", severity, min, severityRule))
+	}
+	if rule.MinAIScore > 0 {
+		if ai == nil || ai.Score < rule.MinAIScore {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("AI score %d >= %d", ai.Score, rule.MinAIScore))
+	}
+	if rule.MinAIConfidence > 0 {
+		if ai == nil || ai.Confidence < rule.MinAIConfidence {
+			return nil, false
+		}
+		reasons = append(reasons, fmt.Sprintf("AI confidence %.2f >= %.2f", ai.Confidence, rule.MinAIConfidence))
+	}
+	if len(reasons) == 0 {
+		reasons = append(reasons, "unconditional rule")
+	}
+	return reasons, true
+}
+
+// maxSeverity returns the highest severity among the matches and the YARA
+// rule that carried it.
+func maxSeverity(matches scanner.MatchRules) (string, string) {
+	best, rule := "", ""
+	for _, match := range matches {
+		if severities[match.Severity] > severities[best] {
+			best, rule = match.Severity, match.Rule
+		}
+	}
+	return best, rule
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"anti-abuse-go/fleet"
+	"anti-abuse-go/logger"
+)
+
+// runFleetServer runs the central fleet server in the foreground until
+// SIGINT or SIGTERM. It does not watch any files itself.
+func runFleetServer() {
+	server, err := fleet.NewServer(loadConfigOrExit())
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to start fleet server")
+	}
+	server.Start()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	logger.Log.Info("Shutting down fleet server...")
+	server.Stop()
+}
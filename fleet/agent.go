@@ -0,0 +1,121 @@
+package fleet
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/history"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/outbox"
+)
+
+const (
+	outboxKind = "fleet.event"
+	eventsPath = "/api/v1/events"
+)
+
+// Agent sends decided detections to the fleet server. Every event goes
+// through the outbox so nothing is lost while the server is unreachable.
+type Agent struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+var defaultAgent *Agent
+
+// SetDefault sets the agent used by the package-level Send.
+func SetDefault(a *Agent) {
+	defaultAgent = a
+}
+
+// Send queues a record for the fleet server. It is a no-op when no fleet
+// server is configured.
+func Send(rec *history.Record) {
+	if defaultAgent == nil {
+		return
+	}
+	if err := outbox.Enqueue(outboxKind, rec); err != nil {
+		logger.Log.WithError(err).Errorf("Dropping fleet event for %s", rec.Path)
+	}
+}
+
+// NewAgent returns the agent for the configured fleet server, or nil when
+// none is configured.
+func NewAgent(cfg *config.Config) (*Agent, error) {
+	if cfg.Fleet.ServerURL == "" {
+		return nil, nil
+	}
+
+	client, err := HTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{
+		url:    strings.TrimSuffix(cfg.Fleet.ServerURL, "/") + eventsPath,
+		token:  cfg.Fleet.Token,
+		client: client,
+	}
+	outbox.RegisterHandler(outboxKind, a.deliver)
+	if strings.HasPrefix(a.url, "http://") {
+		logger.Log.Warn("Fleet server URL is not https, detections are sent in clear text")
+	}
+	logger.Log.Infof("Sending detections to fleet server %s", cfg.Fleet.ServerURL)
+	return a, nil
+}
+
+// HTTPClient returns a client for the fleet server that trusts FLEET.ca_file
+// in addition to the system roots.
+func HTTPClient(cfg *config.Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.Fleet.CAFile != "" {
+		pem, err := os.ReadFile(cfg.Fleet.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fleet CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.Fleet.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+func (a *Agent) deliver(payload json.RawMessage) error {
+	req, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(payload))
+	if err != nil {
+		return outbox.Permanent(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest:
+		// Retrying will not fix a rejected token or payload
+		return outbox.Permanent(fmt.Errorf("fleet server rejected event: %s: %s", resp.Status, strings.TrimSpace(string(body))))
+	default:
+		return fmt.Errorf("fleet server returned %s", resp.Status)
+	}
+}
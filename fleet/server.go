@@ -0,0 +1,477 @@
+package fleet
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/history"
+	"anti-abuse-go/logger"
+)
+
+const (
+	maxEventSize = 1 << 20
+	bundlePrefix = "/api/v1/bundle/"
+)
+
+// HashSummary is one file hash across every machine that reported it.
+type HashSummary struct {
+	SHA256     string    `json:"sha256"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Detections int       `json:"detections"`
+	Machines   []string  `json:"machines"`
+	Servers    []string  `json:"servers"`
+	Rules      []string  `json:"rules"`
+
+	machines, servers, rules map[string]bool
+}
+
+// MachineSummary is the activity of one agent.
+type MachineSummary struct {
+	MachineID  string    `json:"machine_id"`
+	LastSeen   time.Time `json:"last_seen"`
+	Detections int       `json:"detections"`
+}
+
+// Server receives detections from agents, stores them in a history store
+// and answers fleet-wide queries.
+type Server struct {
+	srv        *http.Server
+	stop       chan struct{}
+	tlsCert    string
+	tlsKey     string
+	store      *history.Store
+	agents     map[string]string // token -> machineID
+	queryToken []byte
+	bundlePath string
+
+	mu       sync.Mutex
+	seen     map[string]time.Time // Record IDs, so agent retries are accepted once
+	hashes   map[string]*HashSummary
+	machines map[string]*MachineSummary
+}
+
+func NewServer(cfg *config.Config) (*Server, error) {
+	sc := cfg.Fleet.Server
+	listen := ":9120"
+	if sc.Listen != "" {
+		listen = sc.Listen
+	}
+	if (sc.TLSCert == "") != (sc.TLSKey == "") {
+		return nil, fmt.Errorf("FLEET.SERVER.tls_cert and tls_key must be set together")
+	}
+	if sc.TLSCert == "" && !isLoopback(listen) {
+		return nil, fmt.Errorf("FLEET.SERVER needs tls_cert and tls_key unless it listens on loopback behind a TLS proxy")
+	}
+	if len(sc.Agents) == 0 {
+		return nil, fmt.Errorf("no agents configured in FLEET.SERVER.agents")
+	}
+
+	s := &Server{
+		stop:       make(chan struct{}),
+		tlsCert:    sc.TLSCert,
+		tlsKey:     sc.TLSKey,
+		agents:     make(map[string]string),
+		queryToken: []byte(sc.QueryToken),
+		bundlePath: sc.BundlePath,
+		seen:       make(map[string]time.Time),
+		hashes:     make(map[string]*HashSummary),
+		machines:   make(map[string]*MachineSummary),
+	}
+	for machineID, token := range sc.Agents {
+		if len(token) < 16 {
+			return nil, fmt.Errorf("token for agent %s must be at least 16 characters", machineID)
+		}
+		if other, ok := s.agents[token]; ok {
+			return nil, fmt.Errorf("agents %s and %s share a token", other, machineID)
+		}
+		s.agents[token] = machineID
+	}
+
+	dir := "/var/lib/sentinel/fleet"
+	if sc.DataPath != "" {
+		dir = sc.DataPath
+	}
+	store, err := history.OpenDir(dir, sc.RetentionDays)
+	if err != nil {
+		return nil, err
+	}
+	s.store = store
+
+	// Rebuild the indexes from the retained events
+	records, err := store.Find(history.Query{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fleet events: %w", err)
+	}
+	for _, rec := range records {
+		s.index(rec)
+	}
+	logger.Log.Infof("Loaded %d fleet events (%d unique hashes, %d machines)", len(records), len(s.hashes), len(s.machines))
+
+	s.srv = &http.Server{Addr: listen, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	return s, nil
+}
+
+// Start serves agents and queries in the background.
+func (s *Server) Start() {
+	go func() {
+		var err error
+		if s.tlsCert != "" {
+			err = s.srv.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+		} else {
+			err = s.srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Log.WithError(err).Fatal("Fleet server failed")
+		}
+	}()
+	go s.pruneLoop()
+	logger.Log.Infof("Fleet server listening on %s", s.srv.Addr)
+}
+
+func (s *Server) Stop() {
+	close(s.stop)
+	_ = s.srv.Close()
+	_ = s.store.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch {
+	case r.URL.Path == eventsPath && r.Method == http.MethodPost:
+		s.receive(w, r)
+	case strings.HasPrefix(r.URL.Path, bundlePrefix) && r.Method == http.MethodGet:
+		s.bundleFile(w, r)
+	case r.URL.Path == eventsPath || !strings.HasPrefix(r.URL.Path, "/api/v1/"):
+		writeError(w, http.StatusNotFound, "not found")
+	case r.Method != http.MethodGet:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	case !s.queryAllowed(r):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sentinel-fleet"`)
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+	case r.URL.Path == "/api/v1/detections":
+		s.detections(w, r)
+	case r.URL.Path == "/api/v1/hashes":
+		s.hashList(w, r)
+	case r.URL.Path == "/api/v1/machines":
+		s.machineList(w)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// receive stores one event from an agent. The machine is taken from the
+// token, not from the event, so agents cannot report for each other.
+func (s *Server) receive(w http.ResponseWriter, r *http.Request) {
+	machineID, ok := s.agent(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "missing or invalid agent token")
+		return
+	}
+
+	var rec history.Record
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventSize)).Decode(&rec); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid event: "+err.Error())
+		return
+	}
+	if rec.ID == "" || rec.SHA256 == "" {
+		writeError(w, http.StatusBadRequest, "event needs id and sha256")
+		return
+	}
+	rec.MachineID = machineID
+	rec.SHA256 = strings.ToLower(rec.SHA256)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[rec.ID]; ok {
+		writeJSON(w, http.StatusOK, map[string]bool{"duplicate": true})
+		return
+	}
+	if err := s.store.Add(&rec); err != nil {
+		logger.Log.WithError(err).Error("Failed to store fleet event")
+		writeError(w, http.StatusInternalServerError, "failed to store event")
+		return
+	}
+	s.index(&rec)
+	logger.Log.Infof("Detection from %s: %s (%s)", machineID, rec.Path, strings.Join(rec.Rules(), ", "))
+	writeJSON(w, http.StatusOK, map[string]bool{"duplicate": false})
+}
+
+// bundleFile serves the signed rule bundle to agents. Files are served as
+// published; agents verify the signature themselves.
+func (s *Server) bundleFile(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.agent(r); !ok {
+		writeError(w, http.StatusUnauthorized, "missing or invalid agent token")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, bundlePrefix)
+	if s.bundlePath == "" || name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	f, err := os.Open(filepath.Join(s.bundlePath, name))
+	if err != nil {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = io.Copy(w, f)
+}
+
+// index adds a record to the dedupe and summary indexes. Callers hold mu
+// once the server is running.
+func (s *Server) index(rec *history.Record) {
+	s.seen[rec.ID] = rec.Time
+
+	h, ok := s.hashes[rec.SHA256]
+	if !ok {
+		h = &HashSummary{
+			SHA256:    rec.SHA256,
+			FirstSeen: rec.Time,
+			machines:  make(map[string]bool),
+			servers:   make(map[string]bool),
+			rules:     make(map[string]bool),
+		}
+		s.hashes[rec.SHA256] = h
+	}
+	if rec.Time.Before(h.FirstSeen) {
+		h.FirstSeen = rec.Time
+	}
+	if rec.Time.After(h.LastSeen) {
+		h.LastSeen = rec.Time
+	}
+	h.Detections++
+	h.machines[rec.MachineID] = true
+	if rec.ServerUUID != "" {
+		h.servers[rec.ServerUUID] = true
+	}
+	for _, rule := range rec.Rules() {
+		h.rules[rule] = true
+	}
+
+	m, ok := s.machines[rec.MachineID]
+	if !ok {
+		m = &MachineSummary{MachineID: rec.MachineID}
+		s.machines[rec.MachineID] = m
+	}
+	if rec.Time.After(m.LastSeen) {
+		m.LastSeen = rec.Time
+	}
+	m.Detections++
+}
+
+// pruneLoop drops index entries once the store has deleted their events.
+func (s *Server) pruneLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.prune(s.store.Cutoff())
+		}
+	}
+}
+
+// prune drops the record IDs, hashes and machines last seen before cutoff.
+// Counts of hashes and machines still seen keep their older detections
+// until the server restarts.
+func (s *Server) prune(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, t := range s.seen {
+		if t.Before(cutoff) {
+			delete(s.seen, id)
+		}
+	}
+	for sha, h := range s.hashes {
+		if h.LastSeen.Before(cutoff) {
+			delete(s.hashes, sha)
+		}
+	}
+	for id, m := range s.machines {
+		if m.LastSeen.Before(cutoff) {
+			delete(s.machines, id)
+		}
+	}
+}
+
+func (s *Server) detections(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := history.Query{
+		Machine: params.Get("machine"),
+		Server:  params.Get("server"),
+		Rule:    params.Get("rule"),
+		Hash:    params.Get("hash"),
+		Limit:   100,
+		From:    time.Now().AddDate(0, 0, -7),
+	}
+	limit, err := intParam(params.Get("limit"), q.Limit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	q.Limit = limit
+	if v := params.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+		q.From = time.Now().Add(-d)
+	}
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := params.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid %s, expected RFC3339", name))
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	records, err := s.store.Find(q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if records == nil {
+		records = []*history.Record{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
+
+// hashList returns the unique hashes, most widespread first.
+func (s *Server) hashList(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	minMachines, err := intParam(params.Get("min_machines"), 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid min_machines")
+		return
+	}
+	limit, err := intParam(params.Get("limit"), 100)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+
+	s.mu.Lock()
+	list := make([]HashSummary, 0)
+	for _, h := range s.hashes {
+		if len(h.machines) < minMachines {
+			continue
+		}
+		summary := *h
+		summary.Machines = sortedSet(h.machines)
+		summary.Servers = sortedSet(h.servers)
+		summary.Rules = sortedSet(h.rules)
+		list = append(list, summary)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].Machines) != len(list[j].Machines) {
+			return len(list[i].Machines) > len(list[j].Machines)
+		}
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// machineList returns every configured agent with its activity, including
+// agents that never reported.
+func (s *Server) machineList(w http.ResponseWriter) {
+	s.mu.Lock()
+	list := make([]MachineSummary, 0, len(s.agents))
+	for _, machineID := range s.agents {
+		if m, ok := s.machines[machineID]; ok {
+			list = append(list, *m)
+		} else {
+			list = append(list, MachineSummary{MachineID: machineID})
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].MachineID < list[j].MachineID })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// agent returns the machine an agent token belongs to.
+func (s *Server) agent(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+	for known, machineID := range s.agents {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return machineID, true
+		}
+	}
+	return "", false
+}
+
+func (s *Server) queryAllowed(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && len(s.queryToken) > 0 && subtle.ConstantTimeCompare([]byte(token), s.queryToken) == 1
+}
+
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func intParam(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	return n, nil
+}
+
+func sortedSet(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for v := range set {
+		list = append(list, v)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
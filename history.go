@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"anti-abuse-go/history"
+	"anti-abuse-go/logger"
+)
+
+// runHistoryCommand queries the detection history on disk. It does not need
+// the daemon to be running.
+func runHistoryCommand(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	since := fs.Duration("since", 0, "Only detections within this duration (e.g. 24h)")
+	from := fs.String("from", "", "Start time, RFC3339 or YYYY-MM-DD")
+	to := fs.String("to", "", "End time, RFC3339 or YYYY-MM-DD (the whole day)")
+	rule := fs.String("rule", "", "Only detections matching this YARA rule")
+	server := fs.String("server", "", "Only detections for this server UUID")
+	hash := fs.String("hash", "", "Only detections with this MD5, SHA1 or SHA256")
+	limit := fs.Int("limit", 0, "Show at most this many of the latest detections")
+	format := fs.String("format", "table", "Output format: table, json or csv")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sentinel history [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	q := history.Query{Rule: *rule, Server: *server, Hash: *hash, Limit: *limit}
+	var err error
+	if *from != "" {
+		if q.From, err = parseHistoryTime(*from, false); err != nil {
+			logger.Log.WithError(err).Fatal("Invalid -from")
+		}
+	}
+	if *to != "" {
+		if q.To, err = parseHistoryTime(*to, true); err != nil {
+			logger.Log.WithError(err).Fatal("Invalid -to")
+		}
+	}
+	if *since > 0 {
+		q.From = time.Now().Add(-*since)
+	}
+
+	store, err := history.Open(loadConfigOrExit())
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to open detection history")
+	}
+	records, err := store.Find(q)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to read detection history")
+	}
+
+	switch *format {
+	case "json":
+		err = history.WriteJSON(os.Stdout, records)
+	case "csv":
+		err = history.WriteCSV(os.Stdout, records)
+	case "table":
+		printHistory(records)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format: %s\n", *format)
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to write output")
+	}
+}
+
+// parseHistoryTime accepts RFC3339 or a local date. A date used as the end
+// of a range covers the whole day.
+func parseHistoryTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not RFC3339 or YYYY-MM-DD", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+func printHistory(records []*history.Record) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "TIME\tSERVER\tACTION\tRULES\tSHA256\tPATH")
+	for _, rec := range records {
+		server := rec.ServerUUID
+		if server == "" {
+			server = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", rec.Time.Format(time.RFC3339), server, rec.Action,
+			strings.Join(rec.Rules(), ", "), rec.SHA256, rec.Path)
+	}
+	fmt.Fprintf(tw, "%d detections\n", len(records))
+}
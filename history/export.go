@@ -0,0 +1,64 @@
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var csvHeader = []string{
+	"id", "time", "machine_id", "server_uuid", "path", "size", "md5", "sha1", "sha256", "rules",
+	"action", "decision_rule", "severity", "ai_score", "ai_confidence", "actions_taken",
+}
+
+// WriteCSV writes records as CSV with a header row. Multi-valued fields are
+// joined with ";".
+func WriteCSV(w io.Writer, records []*Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		score, confidence := "", ""
+		if rec.AI != nil {
+			score = strconv.Itoa(rec.AI.Score)
+			confidence = strconv.FormatFloat(rec.AI.Confidence, 'f', -1, 64)
+		}
+		row := []string{
+			rec.ID,
+			rec.Time.Format(time.RFC3339),
+			rec.MachineID,
+			rec.ServerUUID,
+			rec.Path,
+			strconv.FormatInt(rec.Size, 10),
+			rec.MD5,
+			rec.SHA1,
+			rec.SHA256,
+			strings.Join(rec.Rules(), ";"),
+			rec.Action,
+			rec.Rule,
+			rec.Severity,
+			score,
+			confidence,
+			strings.Join(rec.Actions, ";"),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes records as an indented JSON array.
+func WriteJSON(w io.Writer, records []*Record) error {
+	if records == nil {
+		records = []*Record{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
@@ -0,0 +1,343 @@
+package history
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+const (
+	segmentLayout    = "2006-01-02"
+	segmentExt       = ".jsonl"
+	defaultRetention = 90
+)
+
+// Record is one decided detection as kept in the history.
+type Record struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	MachineID  string    `json:"machine_id,omitempty"`
+	Path       string    `json:"path"`
+	ServerUUID string    `json:"server_uuid,omitempty"`
+	Size       int64     `json:"size"`
+	MD5        string    `json:"md5"`
+	SHA1       string    `json:"sha1"`
+	SHA256     string    `json:"sha256"`
+	Matches    []Match   `json:"matches"`
+	AI         *AI       `json:"ai,omitempty"`
+	Action     string    `json:"action"`
+	Rule       string    `json:"decision_rule,omitempty"`
+	Severity   string    `json:"severity,omitempty"`
+	Actions    []string  `json:"actions_taken,omitempty"` // e.g. alert, quarantine:<id>, plugin:<name>
+}
+
+// Match is a YARA rule that matched the file.
+type Match struct {
+	Rule     string `json:"rule"`
+	Tags     string `json:"tags,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Member   string `json:"member,omitempty"`
+}
+
+// AI is the AI verdict the decision was based on.
+type AI struct {
+	Score      int     `json:"score"`
+	Confidence float64 `json:"confidence"`
+	Category   string  `json:"category,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+	Provider   string  `json:"provider,omitempty"`
+	Model      string  `json:"model,omitempty"`
+}
+
+// Rules returns the names of the matched rules.
+func (r *Record) Rules() []string {
+	rules := make([]string, 0, len(r.Matches))
+	for _, m := range r.Matches {
+		rules = append(rules, m.Rule)
+	}
+	return rules
+}
+
+var defaultStore *Store
+
+// SetDefault sets the store used by the package-level Add.
+func SetDefault(s *Store) {
+	defaultStore = s
+}
+
+// Add appends a record to the default store. It is a no-op until a store
+// is set, so detections are never held up by the history. The record's ID
+// and time are filled in either way.
+func Add(rec *Record) {
+	if rec.ID == "" {
+		rec.ID = newID()
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if defaultStore == nil {
+		return
+	}
+	if err := defaultStore.Add(rec); err != nil {
+		logger.Log.WithError(err).Warnf("Failed to record %s in history", rec.Path)
+	}
+}
+
+// Store is an append-only detection log split into one JSONL segment per
+// UTC day. Segments older than the retention are deleted when the day rolls.
+type Store struct {
+	dir       string
+	retention int // Days
+
+	mu      sync.Mutex
+	day     string
+	segment *os.File
+}
+
+func Open(cfg *config.Config) (*Store, error) {
+	dir := "/var/lib/sentinel/history"
+	if cfg.History.Path != "" {
+		dir = cfg.History.Path
+	}
+	return OpenDir(dir, cfg.History.RetentionDays)
+}
+
+// OpenDir opens a store in dir that keeps records for retention days, or
+// the default of 90 when retention is not positive.
+func OpenDir(dir string, retention int) (*Store, error) {
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	return &Store{dir: dir, retention: retention}, nil
+}
+
+// Add appends a record, filling in its ID and time when unset.
+func (s *Store) Add(rec *Record) error {
+	if rec.ID == "" {
+		rec.ID = newID()
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if day := rec.Time.UTC().Format(segmentLayout); day != s.day || s.segment == nil {
+		if err := s.openSegment(day); err != nil {
+			return err
+		}
+		s.prune()
+	}
+	_, err = s.segment.Write(line)
+	return err
+}
+
+// Close closes the current segment.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.segment == nil {
+		return nil
+	}
+	err := s.segment.Close()
+	s.segment = nil
+	return err
+}
+
+func (s *Store) openSegment(day string) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, day+segmentExt), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history segment: %w", err)
+	}
+	if err := terminateLine(f); err != nil {
+		f.Close()
+		return err
+	}
+	if s.segment != nil {
+		s.segment.Close()
+	}
+	s.segment, s.day = f, day
+	return nil
+}
+
+// terminateLine ends a record torn by a crash so the next one starts on its
+// own line.
+func terminateLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = f.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// Cutoff is the start of the oldest UTC day the store keeps. Records
+// before it are deleted with their segment.
+func (s *Store) Cutoff() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()-s.retention, 0, 0, 0, 0, time.UTC)
+}
+
+// prune deletes segments older than the retention.
+func (s *Store) prune() {
+	cutoff := s.Cutoff().Format(segmentLayout)
+	days, err := s.segments()
+	if err != nil {
+		logger.Log.WithError(err).Warn("Failed to list history segments")
+		return
+	}
+	for _, day := range days {
+		if day >= cutoff {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, day+segmentExt)); err != nil {
+			logger.Log.WithError(err).Warnf("Failed to remove history segment %s", day)
+			continue
+		}
+		logger.Log.Debugf("Removed history segment %s", day)
+	}
+}
+
+// segments returns the days that have a segment, oldest first.
+func (s *Store) segments() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, file := range files {
+		day := strings.TrimSuffix(filepath.Base(file), segmentExt)
+		if _, err := time.Parse(segmentLayout, day); err == nil {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// Query selects records. Zero fields match everything.
+type Query struct {
+	From    time.Time
+	To      time.Time
+	Rule    string
+	Server  string
+	Machine string
+	Hash    string // MD5, SHA1 or SHA256
+	Limit   int    // Keep only the most recent records
+}
+
+func (q *Query) match(rec *Record) bool {
+	if !q.From.IsZero() && rec.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && rec.Time.After(q.To) {
+		return false
+	}
+	if q.Server != "" && rec.ServerUUID != q.Server {
+		return false
+	}
+	if q.Machine != "" && rec.MachineID != q.Machine {
+		return false
+	}
+	if q.Hash != "" && !strings.EqualFold(rec.SHA256, q.Hash) && !strings.EqualFold(rec.SHA1, q.Hash) && !strings.EqualFold(rec.MD5, q.Hash) {
+		return false
+	}
+	if q.Rule != "" {
+		for _, m := range rec.Matches {
+			if strings.EqualFold(m.Rule, q.Rule) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Find returns the records matching the query, oldest first.
+func (s *Store) Find(q Query) ([]*Record, error) {
+	days, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, day := range days {
+		// Segments are per UTC day, so whole days outside the range are skipped
+		if !q.From.IsZero() && day < q.From.UTC().Format(segmentLayout) {
+			continue
+		}
+		if !q.To.IsZero() && day > q.To.UTC().Format(segmentLayout) {
+			continue
+		}
+		found, err := s.readSegment(day, &q)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[len(records)-q.Limit:]
+	}
+	return records, nil
+}
+
+func (s *Store) readSegment(day string, q *Query) ([]*Record, error) {
+	f, err := os.Open(filepath.Join(s.dir, day+segmentExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Pruned since it was listed
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*Record
+	reader := bufio.NewScanner(f)
+	reader.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; reader.Scan(); line++ {
+		var rec Record
+		if err := json.Unmarshal(reader.Bytes(), &rec); err != nil {
+			// A torn write from a crash only loses that one record
+			logger.Log.WithError(err).Debugf("Skipping unreadable history record %s:%d", day, line)
+			continue
+		}
+		if q.match(&rec) {
+			records = append(records, &rec)
+		}
+	}
+	return records, reader.Err()
+}
+
+func newID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b[:]))
+}
@@ -2,160 +2,311 @@ package integrations
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"anti-abuse-go/config"
 	"anti-abuse-go/logger"
+	"anti-abuse-go/metrics"
+	"anti-abuse-go/scanner"
 )
 
+// AI verdict categories accepted from the model
+var aiCategories = map[string]bool{
+	"crypto-mining":    true,
+	"shell-access":     true,
+	"proxy":            true,
+	"disk-filling":     true,
+	"tor":              true,
+	"ddos":             true,
+	"resource-abuse":   true,
+	"credential-theft": true,
+	"malware":          true,
+	"benign":           true,
+	"other":            true,
+}
+
+// DefaultAIPrompt is used when INTEGRATION.AI.prompt is empty.
+const DefaultAIPrompt = `You are a malware analyst reviewing a file flagged on a game server host.
+File: {{.FilePath}}
+Matched YARA rules: {{.Rules}}
+
+Rate how likely this file is abusive. Example abuses: Crypto Mining, Shell Access, Nezha Proxy (VPN/Proxy usage), Disk Filling, Tor, DDoS, Abusive Resource Usage.
+Respond with only a JSON object, no extra text:
+{"score": <integer 0-10>, "category": "<crypto-mining|shell-access|proxy|disk-filling|tor|ddos|resource-abuse|credential-theft|malware|benign|other>", "reason": "<one sentence>", "confidence": <number 0.0-1.0>}
+
+Content:
+{{.Excerpt}}`
+
+// legacyPromptContext is appended to prompts written before templating,
+// which only contained instructions.
+const legacyPromptContext = `
+
+File: {{.FilePath}}
+Matched YARA rules: {{.Rules}}
+Content:
+{{.Excerpt}}`
+
 type AIAnalysis struct {
-	Score   int    `json:"score"`
-	Reason  string `json:"reason"`
-	Content string `json:"content"`
+	Score      int     `json:"score"`
+	Category   string  `json:"category"`
+	Reason     string  `json:"reason"`
+	Confidence float64 `json:"confidence"`
+	Structured bool    `json:"structured"` // False when the verdict was recovered from free text
+	Content    string  `json:"content"`    // Raw model output
+	Provider   string  `json:"provider"`
+	Model      string  `json:"model"`
 }
 
-func AnalyzeWithAI(cfg *config.Config, content string) (*AIAnalysis, error) {
+// AIRequest describes a flagged file to analyze.
+type AIRequest struct {
+	FilePath string
+	Content  []byte
+	Matches  scanner.MatchRules
+}
+
+// Summary renders the verdict for alerts.
+func (a *AIAnalysis) Summary() string {
+	if !a.Structured && a.Reason == "" {
+		return a.Content
+	}
+	summary := fmt.Sprintf("**%d/10**", a.Score)
+	if a.Category != "" {
+		summary += " " + a.Category
+	}
+	if a.Structured {
+		summary += fmt.Sprintf(" (%.0f%% confidence)", a.Confidence*100)
+	}
+	return summary + " - " + a.Reason
+}
+
+// AnalyzeWithAI prepares the file content into chunks that fit the token
+// budget, analyzes each chunk and combines the verdicts into one. Cancelling
+// ctx aborts the provider calls. charge, when set, is asked before each
+// provider call and stops the analysis when it returns false.
+func AnalyzeWithAI(ctx context.Context, cfg *config.Config, req AIRequest, charge func() bool) (*AIAnalysis, error) {
 	if !cfg.Integration.AI.Enabled {
 		return nil, nil
 	}
 
-	for _, model := range cfg.Integration.AI.GenerateModels {
-		analysis, err := callAI(cfg, model, content)
-		if err == nil {
-			return analysis, nil
-		}
-		logger.Log.WithError(err).Warnf("AI model %s failed, trying next", model)
+	rules := make([]string, 0, len(req.Matches))
+	for _, match := range req.Matches {
+		rules = append(rules, match.Rule)
 	}
 
-	return nil, fmt.Errorf("all AI models failed")
-}
+	chunks := prepareAIContent(cfg, req.FilePath, req.Content, req.Matches)
+	if len(chunks) == 0 {
+		chunks = []string{""}
+	}
 
-func callAI(cfg *config.Config, model, content string) (*AIAnalysis, error) {
-	prompt := fmt.Sprintf(cfg.Integration.AI.Prompt, content)
-
-	var payload map[string]interface{}
-	var url string
-
-	if cfg.Integration.AI.UseGroq {
-		url = "https://api.groq.com/openai/v1/chat/completions"
-		payload = map[string]interface{}{
-			"model": model,
-			"messages": []map[string]string{
-				{"role": "user", "content": prompt},
-			},
-			"temperature": 0.1,
-			"max_tokens":  512,
+	var verdicts []*AIAnalysis
+	var lastErr error
+	for i, chunk := range chunks {
+		if len(chunks) > 1 {
+			chunk = fmt.Sprintf("[part %d of %d]\n%s", i+1, len(chunks), chunk)
 		}
-	} else {
-		url = cfg.Integration.AI.GenerateEndpoint
-		payload = map[string]interface{}{
-			"model":  model,
-			"prompt": prompt,
-			"stream": false,
+		analysis, err := analyzeChunk(ctx, cfg, req.FilePath, rules, chunk, charge)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil || errors.Is(err, ErrAIBudgetExceeded) {
+				break
+			}
+			continue
 		}
+		verdicts = append(verdicts, analysis)
 	}
 
-	data, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
+	if len(verdicts) == 0 {
+		return nil, lastErr
 	}
+	return combineVerdicts(verdicts), nil
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+// analyzeChunk walks the provider fallback chain in order, trying each
+// provider's models until one answers.
+func analyzeChunk(ctx context.Context, cfg *config.Config, filePath string, rules []string, excerpt string, charge func() bool) (*AIAnalysis, error) {
+	// The AI endpoint may be remote, so secrets are masked like any other outbound data
+	excerpt = GetRedactor(cfg).Redact(excerpt)
+	prompt, err := renderPrompt(cfg, filePath, rules, excerpt)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	if cfg.Integration.AI.UseGroq {
-		req.Header.Set("Authorization", "Bearer "+cfg.Integration.AI.GroqAPIKey)
-	}
+	for _, provider := range aiProviders(cfg) {
+		for _, model := range provider.Models() {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if charge != nil && !charge() {
+				return nil, ErrAIBudgetExceeded
+			}
+			start := time.Now()
+			text, err := provider.Generate(ctx, model, prompt)
+			result := "success"
+			if err != nil {
+				result = "failure"
+			}
+			metrics.AIDuration.Observe(time.Since(start).Seconds(), provider.Name(), result)
+			if err != nil {
+				logger.Log.WithError(err).Warnf("AI model %s on %s failed, trying next", model, provider.Name())
+				continue
+			}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+			analysis := parseAIResponse(text)
+			analysis.Provider = provider.Name()
+			analysis.Model = model
+			return analysis, nil
+		}
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+	return nil, fmt.Errorf("all AI providers failed")
+}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("AI API returned status %d: %s", resp.StatusCode, string(body))
+// combineVerdicts keeps the most severe chunk verdict, so one abusive part
+// flags the whole file. Ties are broken by confidence.
+func combineVerdicts(verdicts []*AIAnalysis) *AIAnalysis {
+	best := verdicts[0]
+	for _, v := range verdicts[1:] {
+		if v.Score > best.Score || (v.Score == best.Score && v.Confidence > best.Confidence) {
+			best = v
+		}
+	}
+	if len(verdicts) == 1 {
+		return best
 	}
 
-	return parseAIResponse(cfg, body)
+	combined := *best
+	contents := make([]string, 0, len(verdicts))
+	for i, v := range verdicts {
+		contents = append(contents, fmt.Sprintf("[part %d] %s", i+1, v.Content))
+		combined.Structured = combined.Structured || v.Structured
+	}
+	combined.Content = strings.Join(contents, "\n")
+	combined.Reason = fmt.Sprintf("%s (worst of %d parts)", best.Reason, len(verdicts))
+	return &combined
 }
 
-func extractGroqContent(response map[string]interface{}) (string, error) {
-	choices, ok := response["choices"].([]interface{})
-	if !ok || len(choices) == 0 {
-		return "", fmt.Errorf("no choices in Groq response")
+func promptTemplate(cfg *config.Config) string {
+	prompt := cfg.Integration.AI.Prompt
+	if prompt == "" {
+		return DefaultAIPrompt
 	}
-	choice, ok := choices[0].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid choice format")
+	if !strings.Contains(prompt, "{{") {
+		return prompt + legacyPromptContext
 	}
-	msg, ok := choice["message"].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("no message in choice")
+	return prompt
+}
+
+func renderPrompt(cfg *config.Config, filePath string, rules []string, excerpt string) (string, error) {
+	tmpl, err := template.New("prompt").Parse(promptTemplate(cfg))
+	if err != nil {
+		return "", fmt.Errorf("invalid AI prompt template: %w", err)
 	}
-	content, ok := msg["content"].(string)
-	if !ok {
-		return "", fmt.Errorf("no content in message")
+
+	ruleList := strings.Join(rules, ", ")
+	if ruleList == "" {
+		ruleList = "none"
 	}
-	return content, nil
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, struct {
+		FilePath string
+		Rules    string
+		Excerpt  string
+	}{filePath, ruleList, excerpt})
+	if err != nil {
+		return "", fmt.Errorf("failed to render AI prompt: %w", err)
+	}
+	return buf.String(), nil
 }
 
-func parseAIResponse(cfg *config.Config, body []byte) (*AIAnalysis, error) {
-	var response map[string]interface{}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("failed to parse AI response JSON: %w", err)
+var (
+	jsonObjectRegex = regexp.MustCompile(`(?s)\{.*\}`)
+	freeScoreRegex  = regexp.MustCompile(`(?i)(?:\*\*\s*)?(\d{1,2})\s*/\s*10`)
+)
+
+// parseAIResponse validates the JSON verdict requested by the prompt and
+// falls back to free text ("**5/10** reason") when the model ignores it.
+func parseAIResponse(content string) *AIAnalysis {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return &AIAnalysis{Content: "No content in AI response"}
 	}
 
-	var content string
-	if cfg.Integration.AI.UseGroq {
-		var err error
-		content, err = extractGroqContent(response)
-		if err != nil {
-			logger.Log.WithError(err).Warnf("Failed to extract Groq response content")
-			content = fmt.Sprintf("Error in AI response: %v", err)
-		}
-	} else {
-		if resp, ok := response["response"].(string); ok {
-			content = resp
+	analysis, err := parseJSONVerdict(content)
+	if err == nil {
+		return analysis
+	}
+	logger.Log.WithError(err).Debug("AI response is not a valid JSON verdict, falling back to free text")
+
+	analysis = &AIAnalysis{Content: content}
+	if m := freeScoreRegex.FindStringSubmatchIndex(content); m != nil {
+		score, _ := strconv.Atoi(content[m[2]:m[3]])
+		if score > 10 {
+			score = 10
 		}
+		analysis.Score = score
+		analysis.Reason = strings.TrimSpace(strings.Trim(content[m[1]:], "* -:"))
 	}
+	return analysis
+}
 
-	if content == "" {
-		return &AIAnalysis{Content: "No content in AI response"}, nil
+func parseJSONVerdict(content string) (*AIAnalysis, error) {
+	raw := jsonObjectRegex.FindString(content)
+	if raw == "" {
+		return nil, fmt.Errorf("no JSON object in response")
+	}
+
+	var verdict struct {
+		Score      *float64 `json:"score"`
+		Category   string   `json:"category"`
+		Reason     string   `json:"reason"`
+		Confidence *float64 `json:"confidence"`
+	}
+	if err := json.Unmarshal([]byte(raw), &verdict); err != nil {
+		return nil, err
 	}
 
-	// Parse score and reason from response like "**5/10** reason"
-	parts := strings.SplitN(content, "**", 3)
-	if len(parts) < 3 {
-		return &AIAnalysis{Content: content}, nil
+	if verdict.Score == nil {
+		return nil, fmt.Errorf("missing score")
+	}
+	if *verdict.Score < 0 || *verdict.Score > 10 {
+		return nil, fmt.Errorf("score %v out of range 0-10", *verdict.Score)
+	}
+	if strings.TrimSpace(verdict.Reason) == "" {
+		return nil, fmt.Errorf("missing reason")
 	}
 
-	scorePart := strings.Trim(parts[1], "/10 ")
-	score := 0
-	if _, err := fmt.Sscanf(scorePart, "%d", &score); err != nil {
-		logger.Log.WithError(err).Warnf("Failed to parse abuse score from: %s", scorePart)
-		score = 0
+	confidence := 0.5
+	if verdict.Confidence != nil {
+		confidence = *verdict.Confidence
+		// Some models answer in percent
+		if confidence > 1 && confidence <= 100 {
+			confidence /= 100
+		}
+		if confidence < 0 || confidence > 1 {
+			return nil, fmt.Errorf("confidence %v out of range 0-1", *verdict.Confidence)
+		}
 	}
 
-	reason := strings.TrimSpace(parts[2])
+	category := strings.ToLower(strings.TrimSpace(verdict.Category))
+	if !aiCategories[category] {
+		category = "other"
+	}
 
 	return &AIAnalysis{
-		Score:   score,
-		Reason:  reason,
-		Content: content,
+		Score:      int(*verdict.Score + 0.5),
+		Category:   category,
+		Reason:     strings.TrimSpace(verdict.Reason),
+		Confidence: confidence,
+		Structured: true,
+		Content:    content,
 	}, nil
 }
@@ -0,0 +1,312 @@
+package integrations
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/scanner"
+)
+
+const (
+	minStringLength  = 6
+	matchWindowChars = 1024
+	maxArchiveEntry  = 10 * 1024 * 1024
+)
+
+// Archive entries that are sent as text rather than as extracted strings
+var textEntryExts = map[string]bool{
+	".yml": true, ".yaml": true, ".json": true, ".properties": true, ".txt": true,
+	".sh": true, ".js": true, ".py": true, ".toml": true, ".cfg": true, ".conf": true,
+	".xml": true, ".mf": true,
+}
+
+var classDescriptorRegex = regexp.MustCompile(`^(\(.*\).+|\[*L[\w/$]+;|\[+[BCDFIJSZ])$`)
+
+func chunkSettings(cfg *config.Config) (chunkChars, maxChunks int) {
+	chunkTokens := 3000
+	if cfg.Integration.AI.ChunkTokens > 0 {
+		chunkTokens = cfg.Integration.AI.ChunkTokens
+	}
+	maxChunks = 4
+	if cfg.Integration.AI.MaxChunks > 0 {
+		maxChunks = cfg.Integration.AI.MaxChunks
+	}
+	// Rough estimate of four characters per token
+	return chunkTokens * 4, maxChunks
+}
+
+// prepareAIContent turns a flagged file into at most maxChunks text chunks
+// that fit the token budget: readable text is sent as is or as windows
+// around the YARA matches, binaries are reduced to printable strings and
+// archives to their text entries and class file constants.
+func prepareAIContent(cfg *config.Config, filePath string, content []byte, matches scanner.MatchRules) []string {
+	chunkChars, maxChunks := chunkSettings(cfg)
+	budget := chunkChars * maxChunks
+
+	var text string
+	switch {
+	case isZipPath(filePath):
+		text = archiveText(content, matches, budget)
+	case isBinary(content):
+		text = binaryText(content, budget)
+	case len(content) <= budget:
+		text = string(content)
+	default:
+		text = windowText(content, matches, budget)
+	}
+
+	return chunkText(text, chunkChars, maxChunks)
+}
+
+func isZipPath(p string) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	return ext == ".jar" || ext == ".zip"
+}
+
+// isBinary treats content as binary when it has NUL bytes or is mostly not
+// valid printable UTF-8 in the first 8KB.
+func isBinary(content []byte) bool {
+	sample := content
+	if len(sample) > 8192 {
+		sample = sample[:8192]
+	}
+	if bytes.IndexByte(sample, 0) >= 0 {
+		return true
+	}
+
+	total, bad := len(sample), 0
+	for len(sample) > 0 {
+		r, size := utf8.DecodeRune(sample)
+		if (r == utf8.RuneError && size == 1) || (r < 0x20 && r != '\n' && r != '\r' && r != '\t') {
+			bad++
+		}
+		sample = sample[size:]
+	}
+	return bad*10 > total
+}
+
+// windowText keeps the regions around YARA matches of a large text file,
+// falling back to the start of the file when there are no usable offsets.
+func windowText(content []byte, matches scanner.MatchRules, budget int) string {
+	windows := matchWindows(content, matches, matchWindowChars, budget/(2*matchWindowChars)+1)
+	if len(windows) == 0 {
+		return string(content[:budget])
+	}
+
+	var sb strings.Builder
+	for _, w := range windows {
+		if sb.Len() >= budget {
+			break
+		}
+		fmt.Fprintf(&sb, "--- offset %d-%d ---\n%s\n", w.start, w.end, content[w.start:w.end])
+	}
+	return sb.String()
+}
+
+// binaryText lists the unique printable strings of a binary.
+func binaryText(content []byte, budget int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "[%s, %d bytes; printable strings follow]\n", binaryKind(content), len(content))
+	writeStrings(&sb, printableStrings(content, budget), budget)
+	return sb.String()
+}
+
+func binaryKind(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("\x7fELF")):
+		return "ELF executable"
+	case bytes.HasPrefix(content, []byte("MZ")):
+		return "PE executable"
+	case bytes.HasPrefix(content, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return "Java class file"
+	default:
+		return "binary file"
+	}
+}
+
+// printableStrings returns runs of printable ASCII, stopping once twice the
+// budget has been collected so huge binaries are not walked needlessly.
+func printableStrings(content []byte, budget int) []string {
+	var out []string
+	collected := 0
+	start := -1
+	for i := 0; i <= len(content); i++ {
+		if i < len(content) && content[i] >= 0x20 && content[i] < 0x7f {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start >= minStringLength {
+			out = append(out, string(content[start:i]))
+			collected += i - start
+			if collected > 2*budget {
+				return out
+			}
+		}
+		start = -1
+	}
+	return out
+}
+
+func writeStrings(sb *strings.Builder, strs []string, budget int) {
+	seen := make(map[string]bool)
+	for _, s := range strs {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		if sb.Len()+len(s)+1 > budget {
+			return
+		}
+		sb.WriteString(s)
+		sb.WriteByte('\n')
+	}
+}
+
+// archiveText extracts text entries and class constants from a zip/jar,
+// starting with the entries YARA matched.
+func archiveText(content []byte, matches scanner.MatchRules, budget int) string {
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return binaryText(content, budget)
+	}
+
+	matched := make(map[string]bool)
+	for _, match := range matches {
+		if match.Member != "" {
+			matched[strings.SplitN(match.Member, "/", 2)[0]] = true
+			matched[match.Member] = true
+		}
+	}
+
+	ordered := make([]*zip.File, 0, len(reader.File))
+	for _, file := range reader.File {
+		if matched[file.Name] {
+			ordered = append(ordered, file)
+		}
+	}
+	for _, file := range reader.File {
+		if !matched[file.Name] {
+			ordered = append(ordered, file)
+		}
+	}
+
+	var sb strings.Builder
+	for _, file := range ordered {
+		if sb.Len() >= budget {
+			break
+		}
+		if file.FileInfo().IsDir() || file.UncompressedSize64 > maxArchiveEntry {
+			continue
+		}
+		data, err := readZipEntry(file)
+		if err != nil {
+			continue
+		}
+
+		ext := strings.ToLower(path.Ext(file.Name))
+		switch {
+		case ext == ".class":
+			fmt.Fprintf(&sb, "=== %s (class constants) ===\n", file.Name)
+			writeStrings(&sb, classConstants(data), budget)
+		case textEntryExts[ext] && !isBinary(data):
+			fmt.Fprintf(&sb, "=== %s ===\n", file.Name)
+			remaining := budget - sb.Len()
+			if remaining <= 0 {
+				return sb.String()
+			}
+			if len(data) > remaining {
+				data = data[:remaining]
+			}
+			sb.Write(data)
+			sb.WriteByte('\n')
+		case matched[file.Name]:
+			fmt.Fprintf(&sb, "=== %s (%s, strings) ===\n", file.Name, binaryKind(data))
+			writeStrings(&sb, printableStrings(data, budget), budget)
+		}
+	}
+	return sb.String()
+}
+
+func readZipEntry(file *zip.File) ([]byte, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(io.LimitReader(rc, maxArchiveEntry))
+}
+
+// classConstants returns the UTF-8 constants of a Java class file's constant
+// pool, skipping type descriptors. This is where URLs, commands and pool
+// addresses of compiled plugins end up.
+func classConstants(data []byte) []string {
+	if len(data) < 10 || binary.BigEndian.Uint32(data) != 0xcafebabe {
+		return nil
+	}
+
+	count := int(binary.BigEndian.Uint16(data[8:]))
+	pos := 10
+	var out []string
+	for i := 1; i < count && pos < len(data); i++ {
+		tag := data[pos]
+		pos++
+		switch tag {
+		case 1: // Utf8
+			if pos+2 > len(data) {
+				return out
+			}
+			n := int(binary.BigEndian.Uint16(data[pos:]))
+			pos += 2
+			if pos+n > len(data) {
+				return out
+			}
+			s := string(data[pos : pos+n])
+			pos += n
+			if len(s) >= 4 && !classDescriptorRegex.MatchString(s) {
+				out = append(out, s)
+			}
+		case 3, 4, 9, 10, 11, 12, 17, 18: // Integer, Float, refs, NameAndType, Dynamic
+			pos += 4
+		case 5, 6: // Long and Double take two slots
+			pos += 8
+			i++
+		case 7, 8, 16, 19, 20: // Class, String, MethodType, Module, Package
+			pos += 2
+		case 15: // MethodHandle
+			pos += 3
+		default:
+			return out
+		}
+	}
+	return out
+}
+
+// chunkText splits text into at most maxChunks chunks, preferring to break
+// at line boundaries.
+func chunkText(text string, chunkChars, maxChunks int) []string {
+	var chunks []string
+	for len(text) > 0 && len(chunks) < maxChunks {
+		if len(text) <= chunkChars {
+			chunks = append(chunks, text)
+			break
+		}
+		cut := chunkChars
+		if nl := strings.LastIndexByte(text[:cut], '\n'); nl > chunkChars*4/5 {
+			cut = nl + 1
+		}
+		chunks = append(chunks, text[:cut])
+		text = text[cut:]
+	}
+	return chunks
+}
@@ -0,0 +1,328 @@
+package integrations
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+// AI alert modes for INTEGRATION.AI.alert_mode
+const (
+	AIAlertFollowUp = "followup" // Alert immediately, send the verdict as a follow-up
+	AIAlertWait     = "wait"     // Hold the alert until the verdict arrives
+)
+
+var (
+	ErrAIQueueFull      = errors.New("AI queue full")
+	ErrAIBudgetExceeded = errors.New("hourly AI budget exhausted")
+	ErrAIStageStopped   = errors.New("AI stage stopped")
+)
+
+// aiStopGrace is how long Stop lets queued analyses finish before it
+// cancels them, well within the daemon's stop timeout.
+const aiStopGrace = 10 * time.Second
+
+// AICallback receives the verdict of an asynchronous analysis.
+type AICallback func(analysis *AIAnalysis, err error)
+
+type aiJob struct {
+	key string
+	req AIRequest
+}
+
+// AIStage runs AI analyses off the watcher workers with bounded
+// concurrency, a verdict cache and an hourly budget of provider requests.
+type AIStage struct {
+	cfg     *config.Config
+	workers int
+	jobs    chan aiJob
+	cache   *verdictCache
+	ctx     context.Context // Cancelled when Stop gives up waiting
+	cancel  context.CancelFunc
+
+	mu       sync.Mutex
+	inflight map[string][]AICallback
+	budget   int
+	used     int
+	hour     time.Time
+	stopped  bool
+
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+func NewAIStage(cfg *config.Config) *AIStage {
+	workers, queueSize, entries, ttl := aiStageSettings(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AIStage{
+		cfg:      cfg,
+		workers:  workers,
+		jobs:     make(chan aiJob, queueSize),
+		cache:    newVerdictCache(entries, ttl),
+		ctx:      ctx,
+		cancel:   cancel,
+		inflight: make(map[string][]AICallback),
+		budget:   cfg.Integration.AI.MaxRequestsPerHour,
+	}
+}
+
+func aiStageSettings(cfg *config.Config) (workers, queueSize, entries int, ttl time.Duration) {
+	workers = 2
+	if cfg.Integration.AI.Concurrency > 0 {
+		workers = cfg.Integration.AI.Concurrency
+	}
+	queueSize = 32
+	if cfg.Integration.AI.QueueSize > 0 {
+		queueSize = cfg.Integration.AI.QueueSize
+	}
+	entries = 10000
+	if cfg.Integration.AI.CacheEntries > 0 {
+		entries = cfg.Integration.AI.CacheEntries
+	}
+	ttl = 24 * time.Hour
+	if cfg.Integration.AI.CacheTTLMinutes > 0 {
+		ttl = time.Duration(cfg.Integration.AI.CacheTTLMinutes) * time.Minute
+	}
+	return workers, queueSize, entries, ttl
+}
+
+// Reload starts a stage for the new configuration that keeps the verdict
+// cache and the used budget of this hour. The caller stops this stage, so
+// that its queued analyses can be waited for on shutdown.
+func (s *AIStage) Reload(cfg *config.Config) *AIStage {
+	next := NewAIStage(cfg)
+	_, _, entries, ttl := aiStageSettings(cfg)
+	next.cache = s.cache
+	next.cache.resize(entries, ttl)
+
+	s.mu.Lock()
+	next.used, next.hour = s.used, s.hour
+	s.mu.Unlock()
+
+	next.Start()
+	return next
+}
+
+// AIAlertMode returns the configured alert mode, defaulting to follow-up.
+func AIAlertMode(cfg *config.Config) string {
+	if cfg.Integration.AI.AlertMode == AIAlertWait {
+		return AIAlertWait
+	}
+	return AIAlertFollowUp
+}
+
+// PromptVersion identifies the prompt and content preparation settings, so
+// cached verdicts are not reused after the prompt changes.
+func PromptVersion(cfg *config.Config) string {
+	chunkChars, maxChunks := chunkSettings(cfg)
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", promptTemplate(cfg), chunkChars, maxChunks)))
+	return hex.EncodeToString(sum[:6])
+}
+
+func (s *AIStage) Start() {
+	for i := 0; i < s.workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	logger.Log.Infof("AI stage started with %d workers", s.workers)
+}
+
+// QueueDepth returns the number of analyses waiting for a worker.
+func (s *AIStage) QueueDepth() int {
+	return len(s.jobs)
+}
+
+// Stop waits up to aiStopGrace for queued analyses to finish, then cancels
+// the running ones; analyses not done by then get ErrAIStageStopped. Later
+// submissions fail with ErrAIStageStopped.
+func (s *AIStage) Stop() {
+	s.stopOnce.Do(func() {
+		s.mu.Lock()
+		s.stopped = true
+		close(s.jobs)
+		s.mu.Unlock()
+
+		finished := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(aiStopGrace):
+			logger.Log.Warnf("AI analyses still running after %s, cancelling them", aiStopGrace)
+			s.cancel()
+			<-finished
+		}
+		s.cancel()
+	})
+}
+
+// Submit queues an analysis. Cached verdicts are delivered immediately;
+// identical content already being analyzed shares the pending verdict. An
+// error is returned when the queue is full or the hourly budget is spent,
+// in which case done is never called. The budget is charged per provider
+// request, so an analysis that runs out midway fails with
+// ErrAIBudgetExceeded through done.
+func (s *AIStage) Submit(req AIRequest, done AICallback) error {
+	sum := sha256.Sum256(req.Content)
+	key := hex.EncodeToString(sum[:]) + ":" + PromptVersion(s.cfg)
+
+	if analysis, ok := s.cache.get(key); ok {
+		logger.Log.Debugf("AI verdict cache hit for %s", req.FilePath)
+		done(analysis, nil)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return ErrAIStageStopped
+	}
+	if waiting, ok := s.inflight[key]; ok {
+		s.inflight[key] = append(waiting, done)
+		return nil
+	}
+	if !s.budgetLeft() {
+		return ErrAIBudgetExceeded
+	}
+
+	select {
+	case s.jobs <- aiJob{key: key, req: req}:
+		s.inflight[key] = []AICallback{done}
+		return nil
+	default:
+		return ErrAIQueueFull
+	}
+}
+
+// budgetLeft reports whether a provider request fits in this hour's budget.
+// It must be called with s.mu held.
+func (s *AIStage) budgetLeft() bool {
+	if s.budget <= 0 {
+		return true
+	}
+	hour := time.Now().Truncate(time.Hour)
+	if !hour.Equal(s.hour) {
+		s.hour = hour
+		s.used = 0
+	}
+	return s.used < s.budget
+}
+
+// charge takes one provider request from the hourly budget.
+func (s *AIStage) charge() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.budgetLeft() {
+		return false
+	}
+	s.used++
+	return true
+}
+
+func (s *AIStage) worker() {
+	defer s.wg.Done()
+	for job := range s.jobs {
+		var analysis *AIAnalysis
+		var err error
+		if s.ctx.Err() != nil {
+			err = ErrAIStageStopped
+		} else {
+			analysis, err = AnalyzeWithAI(s.ctx, s.cfg, job.req, s.charge)
+			if err != nil && s.ctx.Err() != nil {
+				err = ErrAIStageStopped
+			}
+		}
+		if err == nil && analysis != nil {
+			s.cache.put(job.key, analysis)
+		}
+
+		s.mu.Lock()
+		callbacks := s.inflight[job.key]
+		delete(s.inflight, job.key)
+		s.mu.Unlock()
+
+		for _, done := range callbacks {
+			done(analysis, err)
+		}
+	}
+}
+
+// verdictCache is a size-bounded LRU of verdicts with a TTL.
+type verdictCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedVerdict struct {
+	key      string
+	analysis *AIAnalysis
+	expires  time.Time
+}
+
+func newVerdictCache(max int, ttl time.Duration) *verdictCache {
+	return &verdictCache{
+		max:     max,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *verdictCache) resize(max int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max, c.ttl = max, ttl
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedVerdict).key)
+	}
+}
+
+func (c *verdictCache) get(key string) (*AIAnalysis, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedVerdict)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.analysis, true
+}
+
+func (c *verdictCache) put(key string, analysis *AIAnalysis) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&cachedVerdict{key: key, analysis: analysis, expires: time.Now().Add(c.ttl)})
+
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedVerdict).key)
+	}
+}
@@ -0,0 +1,419 @@
+package integrations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/decision"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/metrics"
+	"anti-abuse-go/outbox"
+	"anti-abuse-go/scanner"
+)
+
+// Detection is a single flagged file waiting to be reported.
+type Detection struct {
+	Path       string
+	ServerUUID string
+	Matches    scanner.MatchRules
+	AIAnalysis string
+	Verdict    *decision.Verdict `json:",omitempty"` // Set once the decision engine has run
+	Size       int64
+	MD5        string
+	SHA1       string
+	SHA256     string
+	Excerpt    string `json:",omitempty"` // Redacted context around matches, only for the excerpt policy
+	Time       time.Time
+}
+
+// Alert groups the detections seen for one server within an aggregation window.
+type Alert struct {
+	MachineID  string
+	ServerUUID string
+	FollowUp   bool // Carries AI verdicts for detections that were already alerted
+	Detections []Detection
+	Suppressed int
+	FirstSeen  time.Time
+	LastSeen   time.Time
+}
+
+func (a *Alert) key() string {
+	if a.FollowUp {
+		return a.ServerUUID + "#ai"
+	}
+	return a.ServerUUID
+}
+
+func (a *Alert) add(d Detection, max int) {
+	if a.FirstSeen.IsZero() || d.Time.Before(a.FirstSeen) {
+		a.FirstSeen = d.Time
+	}
+	if d.Time.After(a.LastSeen) {
+		a.LastSeen = d.Time
+	}
+	if len(a.Detections) >= max {
+		a.Suppressed++
+		return
+	}
+	a.Detections = append(a.Detections, d)
+}
+
+func (a *Alert) merge(other *Alert, max int) {
+	for _, d := range other.Detections {
+		a.add(d, max)
+	}
+	a.Suppressed += other.Suppressed
+}
+
+// Notifier delivers aggregated alerts to an external service.
+type Notifier interface {
+	Name() string
+	Notify(alert *Alert) error
+}
+
+// RateLimitError is returned by a notifier when the remote side asked us to back off.
+type RateLimitError struct {
+	Wait time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.Wait)
+}
+
+// RetryAfter returns how long the remote side asked us to wait.
+func (e *RateLimitError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// rateLimiter is a token bucket that can additionally be blocked until a
+// point in time when the remote side returns Retry-After. It is shared by
+// flushes and outbox retries.
+type rateLimiter struct {
+	mu           sync.Mutex
+	rate         float64 // tokens per second
+	burst        float64
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	burst := float64(perMinute) / 6
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   float64(perMinute) / 60,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (r *rateLimiter) allow(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Before(r.blockedUntil) {
+		return false
+	}
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// delay returns how long until allow can next succeed.
+func (r *rateLimiter) delay(now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Before(r.blockedUntil) {
+		return r.blockedUntil.Sub(now)
+	}
+	tokens := r.tokens + now.Sub(r.last).Seconds()*r.rate
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / r.rate * float64(time.Second))
+}
+
+func (r *rateLimiter) block(wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blockedUntil = time.Now().Add(wait)
+}
+
+// limitedNotifier holds back alerts that could not be sent because of rate
+// limiting. Held alerts for the same server are merged, so a burst collapses
+// into a single message with a suppressed count.
+type limitedNotifier struct {
+	Notifier
+	limiter *rateLimiter
+	backlog map[string]*Alert
+}
+
+func (n *limitedNotifier) drain() {
+	keys := make([]string, 0, len(n.backlog))
+	for key := range n.backlog {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		alert := n.backlog[key]
+		if !n.limiter.allow(time.Now()) {
+			logger.Log.Debugf("%s rate limit reached, holding %d alerts", n.Name(), len(n.backlog))
+			return
+		}
+
+		err := n.Notify(alert)
+		var rl *RateLimitError
+		if errors.As(err, &rl) {
+			metrics.Notifications.Inc(n.Name(), "rate_limited")
+			logger.Log.Warnf("%s asked to back off for %s, holding %d alerts", n.Name(), rl.Wait, len(n.backlog))
+			n.limiter.block(rl.Wait)
+			return
+		}
+		if err != nil {
+			metrics.Notifications.Inc(n.Name(), "failure")
+			logger.Log.WithError(err).Warnf("%s notification failed for server %s, queueing for retry", n.Name(), alert.ServerUUID)
+			n.enqueue(alert)
+		} else {
+			metrics.Notifications.Inc(n.Name(), "success")
+		}
+		delete(n.backlog, key)
+	}
+}
+
+func (n *limitedNotifier) outboxKind() string {
+	return "notify." + strings.ToLower(n.Name())
+}
+
+// enqueueBacklog moves every held alert to the outbox.
+func (n *limitedNotifier) enqueueBacklog() {
+	for key, alert := range n.backlog {
+		n.enqueue(alert)
+		delete(n.backlog, key)
+	}
+}
+
+// enqueue hands an alert to the durable outbox so it survives outages and restarts.
+func (n *limitedNotifier) enqueue(alert *Alert) {
+	if err := outbox.Enqueue(n.outboxKind(), alert); err != nil {
+		logger.Log.WithError(err).Errorf("Dropping %s alert for server %s", n.Name(), alert.ServerUUID)
+	}
+}
+
+// Aggregator groups detections per server UUID within a time window and
+// hands one alert per group to every enabled notifier.
+type Aggregator struct {
+	mu          sync.Mutex
+	machineID   string
+	window      time.Duration
+	maxPerAlert int
+	groups      map[string]*Alert
+
+	notifyMu  sync.Mutex // Serializes flushes with notifier changes
+	notifiers []*limitedNotifier
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewAggregator(cfg *config.Config) *Aggregator {
+	a := &Aggregator{
+		groups: make(map[string]*Alert),
+		stop:   make(chan struct{}),
+	}
+	a.Reload(cfg)
+	return a
+}
+
+// Reload applies a new configuration. Pending groups are kept, and alerts
+// held back by a notifier carry over to its replacement or, if the notifier
+// was disabled, go to the outbox.
+func (a *Aggregator) Reload(cfg *config.Config) {
+	window := 30 * time.Second
+	if cfg.Integration.Alerts.WindowSeconds > 0 {
+		window = time.Duration(cfg.Integration.Alerts.WindowSeconds) * time.Second
+	}
+	maxPerAlert := 10
+	if cfg.Integration.Alerts.MaxDetectionsPerAlert > 0 {
+		maxPerAlert = cfg.Integration.Alerts.MaxDetectionsPerAlert
+	}
+
+	var notifiers []*limitedNotifier
+	if cfg.Integration.Discord.Enabled {
+		perMinute := 20
+		if cfg.Integration.Discord.RateLimitPerMinute > 0 {
+			perMinute = cfg.Integration.Discord.RateLimitPerMinute
+		}
+		notifiers = append(notifiers, newLimitedNotifier(&DiscordNotifier{cfg: cfg}, perMinute))
+	}
+
+	a.notifyMu.Lock()
+	defer a.notifyMu.Unlock()
+
+	previous := make(map[string]*limitedNotifier)
+	for _, n := range a.notifiers {
+		previous[n.Name()] = n
+	}
+	for _, n := range notifiers {
+		if old, ok := previous[n.Name()]; ok {
+			n.backlog = old.backlog
+			delete(previous, n.Name())
+		}
+	}
+	for _, old := range previous {
+		old.enqueueBacklog()
+	}
+
+	a.mu.Lock()
+	a.machineID = cfg.MachineID
+	a.window = window
+	a.maxPerAlert = maxPerAlert
+	a.notifiers = notifiers
+	a.mu.Unlock()
+}
+
+func newLimitedNotifier(n Notifier, perMinute int) *limitedNotifier {
+	ln := &limitedNotifier{
+		Notifier: n,
+		limiter:  newRateLimiter(perMinute),
+		backlog:  make(map[string]*Alert),
+	}
+
+	// Retries from the outbox take a token like any flush, so a backlog left
+	// by an outage is sent at the configured rate. Without a token, or when
+	// the remote side answers with Retry-After, the outbox reschedules the
+	// entry without counting an attempt.
+	outbox.RegisterHandler(ln.outboxKind(), func(payload json.RawMessage) error {
+		var alert Alert
+		if err := json.Unmarshal(payload, &alert); err != nil {
+			return outbox.Permanent(err)
+		}
+		if now := time.Now(); !ln.limiter.allow(now) {
+			wait := ln.limiter.delay(now)
+			if wait < time.Second {
+				wait = time.Second
+			}
+			return &RateLimitError{Wait: wait}
+		}
+		err := n.Notify(&alert)
+		var rl *RateLimitError
+		if errors.As(err, &rl) {
+			ln.limiter.block(rl.Wait)
+		}
+		return err
+	})
+	return ln
+}
+
+// Add queues a detection for the next alert of its server.
+func (a *Aggregator) Add(d Detection) {
+	a.add(d, false)
+}
+
+// AddFollowUp queues the AI verdict of an already alerted detection. Verdicts
+// are grouped separately from new detections.
+func (a *Aggregator) AddFollowUp(d Detection) {
+	a.add(d, true)
+}
+
+func (a *Aggregator) add(d Detection, followUp bool) {
+	if d.Time.IsZero() {
+		d.Time = time.Now()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.notifiers) == 0 {
+		return
+	}
+
+	group := &Alert{MachineID: a.machineID, ServerUUID: d.ServerUUID, FollowUp: followUp}
+	if alert, ok := a.groups[group.key()]; ok {
+		group = alert
+	} else {
+		a.groups[group.key()] = group
+	}
+	group.add(d, a.maxPerAlert)
+}
+
+func (a *Aggregator) Start() {
+	a.wg.Add(1)
+	go a.loop()
+}
+
+// Stop flushes every pending group once and stops the flush loop. Alerts
+// still held back by rate limiting are moved to the outbox.
+func (a *Aggregator) Stop() {
+	close(a.stop)
+	a.wg.Wait()
+	a.flush(true)
+
+	a.notifyMu.Lock()
+	defer a.notifyMu.Unlock()
+	for _, n := range a.notifiers {
+		n.enqueueBacklog()
+	}
+}
+
+func (a *Aggregator) loop() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.flush(false)
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+func (a *Aggregator) flush(all bool) {
+	now := time.Now()
+	var due []*Alert
+
+	a.notifyMu.Lock()
+	defer a.notifyMu.Unlock()
+
+	a.mu.Lock()
+	for key, alert := range a.groups {
+		if all || now.Sub(alert.FirstSeen) >= a.window {
+			due = append(due, alert)
+			delete(a.groups, key)
+		}
+	}
+	maxPerAlert := a.maxPerAlert
+	a.mu.Unlock()
+
+	for _, n := range a.notifiers {
+		for _, alert := range due {
+			held, ok := n.backlog[alert.key()]
+			if !ok {
+				held = &Alert{MachineID: alert.MachineID, ServerUUID: alert.ServerUUID, FollowUp: alert.FollowUp}
+				n.backlog[alert.key()] = held
+			}
+			held.merge(alert, maxPerAlert)
+		}
+		if len(n.backlog) > 0 {
+			n.drain()
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package integrations
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/scanner"
+	"anti-abuse-go/serverid"
+)
+
+// Attachment policies for INTEGRATION.DISCORD.attachment
+const (
+	AttachNone      = "none"
+	AttachHashes    = "hashes"
+	AttachExcerpt   = "excerpt"
+	AttachEncrypted = "encrypted"
+)
+
+const maxExcerptWindows = 5
+
+// NewDetection builds a detection for a flagged file, computing its hashes
+// and, when the excerpt policy is active, a redacted excerpt around the
+// matched offsets. The content itself is not kept.
+func NewDetection(cfg *config.Config, path string, content []byte, matches scanner.MatchRules) Detection {
+	md5sum := md5.Sum(content)
+	sha1sum := sha1.Sum(content)
+	sha256sum := sha256.Sum256(content)
+
+	d := Detection{
+		Path:       path,
+		ServerUUID: serverid.FromPath(path),
+		Matches:    matches,
+		Size:       int64(len(content)),
+		MD5:        hex.EncodeToString(md5sum[:]),
+		SHA1:       hex.EncodeToString(sha1sum[:]),
+		SHA256:     hex.EncodeToString(sha256sum[:]),
+		Time:       time.Now(),
+	}
+
+	if attachmentPolicy(cfg) == AttachExcerpt {
+		d.Excerpt = GetRedactor(cfg).Redact(buildExcerpt(content, matches, excerptBytes(cfg)))
+	}
+	return d
+}
+
+func attachmentPolicy(cfg *config.Config) string {
+	switch cfg.Integration.Discord.Attachment {
+	case AttachNone, AttachExcerpt, AttachEncrypted:
+		return cfg.Integration.Discord.Attachment
+	default:
+		return AttachHashes
+	}
+}
+
+func excerptBytes(cfg *config.Config) int {
+	if cfg.Integration.Discord.ExcerptBytes > 0 {
+		return cfg.Integration.Discord.ExcerptBytes
+	}
+	return 256
+}
+
+// buildExcerpt renders up to maxExcerptWindows windows of context around the
+// match offsets in the file itself.
+func buildExcerpt(content []byte, matches scanner.MatchRules, context int) string {
+	var sb strings.Builder
+	for _, w := range matchWindows(content, matches, context, maxExcerptWindows) {
+		fmt.Fprintf(&sb, "--- offset %d-%d ---\n%s\n", w.start, w.end, printable(content[w.start:w.end]))
+	}
+	return sb.String()
+}
+
+type byteWindow struct{ start, end int }
+
+// matchWindows returns merged windows of the given radius around the match
+// offsets. Offsets of archive members are skipped because they do not point
+// into the archive bytes.
+func matchWindows(content []byte, matches scanner.MatchRules, radius, max int) []byteWindow {
+	var offsets []int
+	for _, match := range matches {
+		if match.Member != "" {
+			continue
+		}
+		for _, off := range match.Offsets {
+			if off < uint64(len(content)) {
+				offsets = append(offsets, int(off))
+			}
+		}
+	}
+	sort.Ints(offsets)
+
+	var windows []byteWindow
+	for _, off := range offsets {
+		start, end := off-radius, off+radius
+		if start < 0 {
+			start = 0
+		}
+		if end > len(content) {
+			end = len(content)
+		}
+		if n := len(windows); n > 0 && start <= windows[n-1].end {
+			windows[n-1].end = end
+			continue
+		}
+		windows = append(windows, byteWindow{start, end})
+	}
+	if len(windows) > max {
+		windows = windows[:max]
+	}
+	return windows
+}
+
+func printable(data []byte) string {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		if b == '\n' || b == '\t' || (b >= 0x20 && b < 0x7f) {
+			out[i] = b
+		} else {
+			out[i] = '.'
+		}
+	}
+	return string(out)
+}
+
+// buildAttachment returns the file name and content to attach to an alert
+// according to the configured policy, or an empty name for none.
+func buildAttachment(cfg *config.Config, alert *Alert) (string, []byte, error) {
+	switch attachmentPolicy(cfg) {
+	case AttachNone:
+		return "", nil, nil
+	case AttachExcerpt:
+		return "excerpts.txt", []byte(hashReport(alert, true)), nil
+	case AttachEncrypted:
+		data, err := encryptedArchive(cfg, alert)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("sentinel-%s.zip.enc", alert.LastSeen.Format("20060102-150405")), data, nil
+	default:
+		return "hashes.txt", []byte(hashReport(alert, false)), nil
+	}
+}
+
+func hashReport(alert *Alert, withExcerpts bool) string {
+	var sb strings.Builder
+	for _, d := range alert.Detections {
+		fmt.Fprintf(&sb, "%s\n  size:   %d\n  md5:    %s\n  sha1:   %s\n  sha256: %s\n", d.Path, d.Size, d.MD5, d.SHA1, d.SHA256)
+		if withExcerpts && d.Excerpt != "" {
+			sb.WriteString(d.Excerpt)
+		}
+		sb.WriteString("\n")
+	}
+	if alert.Suppressed > 0 {
+		fmt.Fprintf(&sb, "%d additional detections suppressed\n", alert.Suppressed)
+	}
+	return sb.String()
+}
+
+// encryptedArchive zips the flagged files that are still unchanged on disk
+// and encrypts the archive with the configured key.
+func encryptedArchive(cfg *config.Config, alert *Alert) ([]byte, error) {
+	key, err := attachmentKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	maxSize := int64(8 * 1024 * 1024)
+	if cfg.Integration.Discord.AttachmentMaxMB > 0 {
+		maxSize = int64(cfg.Integration.Discord.AttachmentMaxMB) * 1024 * 1024
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	var total int64
+	var notes strings.Builder
+	for i, d := range alert.Detections {
+		content, err := os.ReadFile(d.Path)
+		if err != nil {
+			fmt.Fprintf(&notes, "%s: not attached (%v)\n", d.Path, err)
+			continue
+		}
+		sum := sha256.Sum256(content)
+		if hex.EncodeToString(sum[:]) != d.SHA256 {
+			fmt.Fprintf(&notes, "%s: not attached (changed since detection)\n", d.Path)
+			continue
+		}
+		if total+int64(len(content)) > maxSize {
+			fmt.Fprintf(&notes, "%s: not attached (size limit reached)\n", d.Path)
+			continue
+		}
+		total += int64(len(content))
+
+		w, err := zw.Create(fmt.Sprintf("%d_%s", i, strings.TrimLeft(d.Path, "/")))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := zw.Create("hashes.txt")
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(w, hashReport(alert, false)+notes.String())
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return encryptAttachment(key, buf.Bytes())
+}
+
+func attachmentKey(cfg *config.Config) ([]byte, error) {
+	key, err := hex.DecodeString(cfg.Integration.Discord.AttachmentKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("attachment_key must be 64 hex characters (32 bytes) for encrypted attachments")
+	}
+	return key, nil
+}
+
+// encryptAttachment seals data with AES-256-GCM. The output is the nonce
+// followed by the ciphertext.
+func encryptAttachment(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// DecryptAttachment opens an encrypted alert attachment with the configured key.
+func DecryptAttachment(cfg *config.Config, data []byte) ([]byte, error) {
+	key, err := attachmentKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("attachment too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
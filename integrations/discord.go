@@ -7,8 +7,8 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"anti-abuse-go/config"
@@ -44,27 +44,72 @@ type DiscordField struct {
 	Inline bool   `json:"inline,omitempty"`
 }
 
-func SendDiscordWebhook(cfg *config.Config, machineID, filePath string, fields []DiscordField, aiAnalysis string) error {
+// DiscordNotifier posts aggregated alerts to a Discord webhook.
+type DiscordNotifier struct {
+	cfg *config.Config
+}
+
+func (d *DiscordNotifier) Name() string {
+	return "Discord"
+}
+
+func (d *DiscordNotifier) Notify(alert *Alert) error {
+	cfg := d.cfg
 	if !cfg.Integration.Discord.Enabled {
 		return nil
 	}
 
 	// Prepend machine ID to fields so it's immediately visible
-	machineField := DiscordField{
+	fields := []DiscordField{{
 		Name:   "Machine ID",
-		Value:  machineID,
+		Value:  alert.MachineID,
 		Inline: true,
+	}}
+	if alert.ServerUUID != "" {
+		fields = append(fields, DiscordField{
+			Name:   "Server",
+			Value:  alert.ServerUUID,
+			Inline: true,
+		})
+	}
+	if len(alert.Detections) == 1 {
+		fields = append(fields, DiscordField{
+			Name:  "SHA256",
+			Value: alert.Detections[0].SHA256,
+		})
+		if verdict := alert.Detections[0].Verdict; verdict != nil {
+			fields = append(fields, DiscordField{
+				Name:  "Decision",
+				Value: verdict.Summary(),
+			})
+		}
+	}
+	fields = append(fields, ruleFields(alert)...)
+	if alert.Suppressed > 0 {
+		fields = append(fields, DiscordField{
+			Name:  "Suppressed",
+			Value: fmt.Sprintf("%d additional detections not listed", alert.Suppressed),
+		})
+	}
+	if len(fields) > 25 { // Discord embed field limit
+		fields = fields[:25]
+	}
+
+	title := fmt.Sprintf("Sentinel Detection Alert - %s", alert.MachineID)
+	color := 65280 // Green for alerts
+	if alert.FollowUp {
+		title = fmt.Sprintf("Sentinel AI Verdict - %s", alert.MachineID)
+		color = 3447003 // Blue for follow-ups
 	}
-	fields = append([]DiscordField{machineField}, fields...)
 
 	embed := DiscordEmbed{
-		Title:       fmt.Sprintf("Sentinel Detection Alert - %s", machineID),
-		Description: aiAnalysis,
-		Color:       65280, // Green for alerts
+		Title:       title,
+		Description: GetRedactor(cfg).Redact(alertDescription(alert)),
+		Color:       color,
 		Fields:      fields,
-		Timestamp:   time.Now().Format(time.RFC3339),
+		Timestamp:   alert.LastSeen.Format(time.RFC3339),
 		Author: &DiscordAuthor{
-			Name: filePath,
+			Name: alertAuthor(alert),
 		},
 	}
 
@@ -82,10 +127,19 @@ func SendDiscordWebhook(cfg *config.Config, machineID, filePath string, fields [
 		return err
 	}
 
-	// Check if file exists and is under 10MB for attachment
+	// Attach according to the configured policy; raw files never leave the host
 	var body io.Reader
 	var contentType string
-	if stat, err := os.Stat(filePath); err == nil && stat.Size() < 10*1024*1024 {
+	var name string
+	var attachment []byte
+	if !alert.FollowUp {
+		name, attachment, err = buildAttachment(cfg, alert)
+		if err != nil {
+			logger.Log.WithError(err).Warn("Failed to build Discord attachment, sending without it")
+			name = ""
+		}
+	}
+	if name != "" {
 		// Create multipart form
 		var buf bytes.Buffer
 		writer := multipart.NewWriter(&buf)
@@ -95,10 +149,8 @@ func SendDiscordWebhook(cfg *config.Config, machineID, filePath string, fields [
 		payloadField.Write(data)
 
 		// Add file
-		fileField, _ := writer.CreateFormFile("file", filepath.Base(filePath))
-		file, _ := os.Open(filePath)
-		defer file.Close()
-		io.Copy(fileField, file)
+		fileField, _ := writer.CreateFormFile("file", name)
+		fileField.Write(attachment)
 
 		writer.Close()
 		body = &buf
@@ -114,10 +166,98 @@ func SendDiscordWebhook(cfg *config.Config, machineID, filePath string, fields [
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return &RateLimitError{Wait: parseRetryAfter(resp)}
+	}
 	if resp.StatusCode != 204 && resp.StatusCode != 200 {
 		return fmt.Errorf("discord webhook failed with status: %d", resp.StatusCode)
 	}
 
-	logger.Log.Info("Discord webhook sent")
+	logger.Log.Infof("Discord webhook sent (%d detections)", len(alert.Detections)+alert.Suppressed)
 	return nil
 }
+
+func alertAuthor(alert *Alert) string {
+	if len(alert.Detections) == 1 && alert.Suppressed == 0 {
+		return alert.Detections[0].Path
+	}
+	total := len(alert.Detections) + alert.Suppressed
+	if alert.ServerUUID != "" {
+		return fmt.Sprintf("%d detections on server %s", total, alert.ServerUUID)
+	}
+	return fmt.Sprintf("%d detections", total)
+}
+
+func alertDescription(alert *Alert) string {
+	if len(alert.Detections) == 1 {
+		return alert.Detections[0].AIAnalysis
+	}
+
+	var sb strings.Builder
+	for _, d := range alert.Detections {
+		rules := make([]string, 0, len(d.Matches))
+		for _, match := range d.Matches {
+			rules = append(rules, match.Rule)
+		}
+		fmt.Fprintf(&sb, "`%s` - %s\n", d.Path, strings.Join(rules, ", "))
+		if d.AIAnalysis != "" {
+			fmt.Fprintf(&sb, "> %s\n", d.AIAnalysis)
+		}
+		if d.Verdict != nil {
+			fmt.Fprintf(&sb, "> Decision: %s\n", d.Verdict.Summary())
+		}
+	}
+	return sb.String()
+}
+
+// ruleFields lists each matched rule once with its tags and hit count.
+func ruleFields(alert *Alert) []DiscordField {
+	var order []string
+	tags := make(map[string]string)
+	counts := make(map[string]int)
+	for _, d := range alert.Detections {
+		for _, match := range d.Matches {
+			if _, ok := counts[match.Rule]; !ok {
+				order = append(order, match.Rule)
+				tags[match.Rule] = match.Tags
+			}
+			counts[match.Rule]++
+		}
+	}
+
+	fields := make([]DiscordField, 0, len(order))
+	for _, rule := range order {
+		value := tags[rule]
+		if value == "" {
+			value = "-"
+		}
+		if counts[rule] > 1 {
+			value = fmt.Sprintf("%s (x%d)", value, counts[rule])
+		}
+		fields = append(fields, DiscordField{
+			Name:   rule,
+			Value:  value,
+			Inline: true,
+		})
+	}
+	return fields
+}
+
+// parseRetryAfter reads the back-off requested by Discord, either from the
+// Retry-After header or the retry_after field of the JSON body.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if header := resp.Header.Get("Retry-After"); header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil {
+			return time.Duration(seconds * float64(time.Second))
+		}
+	}
+
+	var body struct {
+		RetryAfter float64 `json:"retry_after"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.RetryAfter > 0 {
+		return time.Duration(body.RetryAfter * float64(time.Second))
+	}
+
+	return 5 * time.Second
+}
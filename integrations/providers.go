@@ -0,0 +1,242 @@
+package integrations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+// AI provider types for INTEGRATION.AI.providers
+const (
+	ProviderOpenAI = "openai"
+	ProviderOllama = "ollama"
+	ProviderGroq   = "groq"
+)
+
+// AIProvider generates a completion for a prompt with one of its models.
+type AIProvider interface {
+	Name() string
+	Models() []string
+	Generate(ctx context.Context, model, prompt string) (string, error)
+}
+
+// NewAIProvider creates the provider described by a config entry.
+func NewAIProvider(pc config.AIProvider) (AIProvider, error) {
+	timeout := 30 * time.Second
+	if pc.TimeoutSeconds > 0 {
+		timeout = time.Duration(pc.TimeoutSeconds) * time.Second
+	}
+	base := baseProvider{cfg: pc, client: &http.Client{Timeout: timeout}}
+
+	switch strings.ToLower(pc.Type) {
+	case ProviderOpenAI, "":
+		if base.cfg.BaseURL == "" {
+			base.cfg.BaseURL = "https://api.openai.com/v1"
+		}
+		return &openAIProvider{base}, nil
+	case ProviderGroq:
+		if base.cfg.BaseURL == "" {
+			base.cfg.BaseURL = "https://api.groq.com/openai/v1"
+		}
+		return &openAIProvider{base}, nil
+	case ProviderOllama:
+		if base.cfg.BaseURL == "" {
+			base.cfg.BaseURL = "http://localhost:11434"
+		}
+		return &ollamaProvider{base}, nil
+	default:
+		return nil, fmt.Errorf("unknown AI provider type %q", pc.Type)
+	}
+}
+
+// aiProviders returns the configured fallback chain. Configs without a
+// providers list are mapped from the legacy single-endpoint settings.
+func aiProviders(cfg *config.Config) []AIProvider {
+	entries := cfg.Integration.AI.Providers
+	if len(entries) == 0 {
+		entries = []config.AIProvider{legacyProvider(cfg)}
+	}
+
+	var providers []AIProvider
+	for _, entry := range entries {
+		p, err := NewAIProvider(entry)
+		if err != nil {
+			logger.Log.WithError(err).Warnf("Skipping AI provider %s", entry.Name)
+			continue
+		}
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+func legacyProvider(cfg *config.Config) config.AIProvider {
+	ai := cfg.Integration.AI
+	if ai.UseGroq {
+		return config.AIProvider{
+			Name:   "groq",
+			Type:   ProviderGroq,
+			APIKey: ai.GroqAPIKey,
+			Models: ai.GenerateModels,
+		}
+	}
+	return config.AIProvider{
+		Name:    "ollama",
+		Type:    ProviderOllama,
+		BaseURL: strings.TrimSuffix(ai.GenerateEndpoint, "/api/generate"),
+		Models:  ai.GenerateModels,
+	}
+}
+
+type baseProvider struct {
+	cfg    config.AIProvider
+	client *http.Client
+}
+
+func (b *baseProvider) Name() string {
+	if b.cfg.Name != "" {
+		return b.cfg.Name
+	}
+	return b.cfg.Type
+}
+
+func (b *baseProvider) Models() []string {
+	return b.cfg.Models
+}
+
+func (b *baseProvider) maxTokens() int {
+	if b.cfg.MaxTokens > 0 {
+		return b.cfg.MaxTokens
+	}
+	return 512
+}
+
+func (b *baseProvider) temperature() float64 {
+	if b.cfg.Temperature > 0 {
+		return b.cfg.Temperature
+	}
+	return 0.1
+}
+
+// truncatePrompt keeps the prompt within the provider's input budget,
+// estimating four characters per token.
+func (b *baseProvider) truncatePrompt(prompt string) string {
+	if b.cfg.MaxInputTokens <= 0 || len(prompt) <= b.cfg.MaxInputTokens*4 {
+		return prompt
+	}
+	return prompt[:b.cfg.MaxInputTokens*4]
+}
+
+func (b *baseProvider) post(ctx context.Context, url string, payload interface{}, out interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.cfg.APIKey)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("AI API returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to parse AI response JSON: %w", err)
+	}
+	return nil
+}
+
+// openAIProvider talks to any OpenAI-compatible chat completions endpoint
+// (OpenAI, Groq, vLLM, LM Studio, llama.cpp server).
+type openAIProvider struct {
+	baseProvider
+}
+
+func (p *openAIProvider) Generate(ctx context.Context, model, prompt string) (string, error) {
+	payload := map[string]interface{}{
+		"model": model,
+		"messages": []map[string]string{
+			{"role": "user", "content": p.truncatePrompt(prompt)},
+		},
+		"temperature": p.temperature(),
+		"max_tokens":  p.maxTokens(),
+	}
+	if p.cfg.JSONMode {
+		payload["response_format"] = map[string]string{"type": "json_object"}
+	}
+
+	var response struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	url := strings.TrimSuffix(p.cfg.BaseURL, "/") + "/chat/completions"
+	if err := p.post(ctx, url, payload, &response); err != nil {
+		return "", err
+	}
+
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("no choices in %s response", p.Name())
+	}
+	return response.Choices[0].Message.Content, nil
+}
+
+// ollamaProvider talks to Ollama's /api/chat endpoint.
+type ollamaProvider struct {
+	baseProvider
+}
+
+func (p *ollamaProvider) Generate(ctx context.Context, model, prompt string) (string, error) {
+	payload := map[string]interface{}{
+		"model": model,
+		"messages": []map[string]string{
+			{"role": "user", "content": p.truncatePrompt(prompt)},
+		},
+		"stream": false,
+		"options": map[string]interface{}{
+			"temperature": p.temperature(),
+			"num_predict": p.maxTokens(),
+		},
+	}
+	if p.cfg.JSONMode {
+		payload["format"] = "json"
+	}
+
+	var response struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	}
+	url := strings.TrimSuffix(p.cfg.BaseURL, "/") + "/api/chat"
+	if err := p.post(ctx, url, payload, &response); err != nil {
+		return "", err
+	}
+
+	return response.Message.Content, nil
+}
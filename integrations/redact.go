@@ -0,0 +1,85 @@
+package integrations
+
+import (
+	"regexp"
+	"sync"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+const redactedText = "[REDACTED]"
+
+type secretPattern struct {
+	pattern     string
+	replacement string
+}
+
+// defaultSecretPatterns catch the secrets most often found in game server
+// volumes. For key=value style secrets the key is kept so the reader knows
+// what was removed.
+var defaultSecretPatterns = []secretPattern{
+	{`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`, redactedText},
+	{`(?i)\b(\w*(?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key|auth)\w*)(\s*["']?\s*[:=]\s*)["']?[^\s"']+["']?`, "${1}${2}" + redactedText},
+	{`\bAKIA[0-9A-Z]{16}\b`, redactedText},
+	{`\bptl[acr]_[A-Za-z0-9]{20,}\b`, redactedText},
+	{`\bgh[pousr]_[A-Za-z0-9]{36,}\b`, redactedText},
+	{`\bsk-[A-Za-z0-9_-]{20,}\b`, redactedText},
+	{`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\b`, redactedText},
+	{`https://(?:\w+\.)?discord(?:app)?\.com/api/webhooks/\d+/[\w-]+`, redactedText},
+	{`(?i)\b([a-z][a-z0-9+.-]*://[^\s:/@]+:)[^\s@/]+@`, "${1}" + redactedText + "@"},
+}
+
+// Redactor masks secrets in text before it is sent off the host.
+type Redactor struct {
+	patterns     []*regexp.Regexp
+	replacements []string
+}
+
+var (
+	redactorMu    sync.Mutex
+	redactorCfg   *config.Config
+	redactorCache *Redactor
+)
+
+// GetRedactor returns the redactor for the given config, compiling its
+// patterns once per config.
+func GetRedactor(cfg *config.Config) *Redactor {
+	redactorMu.Lock()
+	defer redactorMu.Unlock()
+
+	if redactorCache != nil && redactorCfg == cfg {
+		return redactorCache
+	}
+
+	var sources []secretPattern
+	if !cfg.Integration.Redaction.DisableDefaultPatterns {
+		sources = append(sources, defaultSecretPatterns...)
+	}
+	for _, pattern := range cfg.Integration.Redaction.Patterns {
+		sources = append(sources, secretPattern{pattern, redactedText})
+	}
+
+	r := &Redactor{}
+	for _, src := range sources {
+		re, err := regexp.Compile(src.pattern)
+		if err != nil {
+			logger.Log.WithError(err).Warnf("Ignoring invalid redaction pattern %q", src.pattern)
+			continue
+		}
+		r.patterns = append(r.patterns, re)
+		r.replacements = append(r.replacements, src.replacement)
+	}
+
+	redactorCfg = cfg
+	redactorCache = r
+	return r
+}
+
+// Redact replaces every secret match with a placeholder.
+func (r *Redactor) Redact(text string) string {
+	for i, re := range r.patterns {
+		text = re.ReplaceAllString(text, r.replacements[i])
+	}
+	return text
+}
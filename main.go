@@ -2,18 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"anti-abuse-go/api"
 	"anti-abuse-go/banner"
 	"anti-abuse-go/config"
+	"anti-abuse-go/control"
 	"anti-abuse-go/daemon"
+	"anti-abuse-go/fleet"
+	"anti-abuse-go/history"
 	"anti-abuse-go/logger"
+	"anti-abuse-go/metrics"
+	"anti-abuse-go/outbox"
 	"anti-abuse-go/plugins"
+	"anti-abuse-go/quarantine"
 	"anti-abuse-go/scanner"
+	"anti-abuse-go/sdnotify"
+	"anti-abuse-go/updater"
 	"anti-abuse-go/watcher"
 )
 
@@ -29,6 +42,12 @@ func main() {
 
 	logger.SetLogLevel(*logLevel)
 
+	// Subcommands (e.g. "sentinel outbox list") run and exit without the banner
+	if flag.NArg() > 0 {
+		runCommand(flag.Args())
+		return
+	}
+
 	// Print banner on startup unless daemonized
 	if !*daemonMode {
 		banner.PrintBanner()
@@ -49,7 +68,7 @@ func main() {
 			logger.Log.Fatal(err)
 		}
 	case "stop":
-		if err := daemon.StopDaemon(); err != nil {
+		if err := daemon.StopDaemon(daemon.StopTimeout); err != nil {
 			logger.Log.Fatal(err)
 		}
 	case "restart":
@@ -61,9 +80,7 @@ func main() {
 			logger.Log.Fatal(err)
 		}
 	case "status":
-		if err := daemon.Status(); err != nil {
-			logger.Log.Fatal(err)
-		}
+		os.Exit(daemon.Status())
 	default:
 		runForeground()
 	}
@@ -74,20 +91,60 @@ func runForeground() {
 	if err != nil {
 		logger.Log.WithError(err).Fatal("Failed to load config")
 	}
+	if err := cfg.Validate(); err != nil {
+		logger.Log.WithError(err).Fatal("Invalid config")
+	}
 
 	logger.Log.Infof("Starting %s v%s by %s", config.AppName, config.GetVersion(), config.Company)
 
+	// Only one instance may run; the daemon must own the pidfile for stop/status
+	pid, err := daemon.AcquirePidFile()
+	if err != nil {
+		if *daemonMode || errors.Is(err, daemon.ErrRunning) {
+			logger.Log.WithError(err).Fatal("Failed to acquire pidfile")
+		}
+		logger.Log.WithError(err).Warn("Running without pidfile")
+	}
+	defer pid.Release()
+
+	// Open the outbox before anything can queue deliveries
+	box, err := outbox.Open(cfg)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to open outbox")
+	}
+	outbox.SetDefault(box)
+
+	store, err := quarantine.Open(cfg)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to open quarantine")
+	}
+	quarantine.SetDefault(store)
+
+	records, err := history.Open(cfg)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to open detection history")
+	}
+	history.SetDefault(records)
+
+	agent, err := fleet.NewAgent(cfg)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to set up fleet agent")
+	}
+	fleet.SetDefault(agent)
+
 	// Initialize plugins
 	if err := plugins.InitPlugins(cfg); err != nil {
 		logger.Log.WithError(err).Fatal("Failed to initialize plugins")
 	}
 
 	// Initialize scanner
-	scan, err := scanner.NewScanner(cfg.Detection.SignaturePath)
+	scan, err := scanner.NewScanner(updater.ActivePath(cfg), scannerOptions(cfg))
 	if err != nil {
 		logger.Log.WithError(err).Fatal("Failed to initialize scanner")
 	}
 
+	warnUnratedRules(scan)
+
 	// Initialize watcher
 	watch, err := watcher.NewWatcher(cfg, scan)
 	if err != nil {
@@ -103,13 +160,76 @@ func runForeground() {
 		logger.Log.WithError(err).Fatal("Failed to start watcher")
 	}
 
-	// Wait for shutdown
+	// Start delivering queued notifications, including those left from a previous run
+	box.Start()
+
+	st := &runtimeState{cfg: cfg, watch: watch, scan: scan, started: time.Now()}
+
+	metrics.NewGaugeFunc("sentinel_queue_depth", "File events waiting for a worker.", func() float64 {
+		return float64(watch.Status().QueueDepth)
+	})
+	metrics.NewGaugeFunc("sentinel_ai_queue_depth", "Files waiting for AI analysis.", func() float64 {
+		return float64(watch.Status().AIQueueDepth)
+	})
+	metrics.NewGaugeFunc("sentinel_watched_directories", "Directories watched for changes.", func() float64 {
+		return float64(watch.Status().WatchedDirs)
+	})
+	if cfg.Detection.Profiling.Enabled {
+		top := profilingTop(cfg)
+		metrics.NewGaugeVecFunc("sentinel_rule_scan_seconds", "Time YARA spent per rule since the rules were loaded, slowest rules only.", func(emit func(float64, ...string)) {
+			for _, c := range scan.SlowRules(top).Rules {
+				emit(c.Cost.Seconds(), c.Namespace, c.Rule)
+			}
+		}, "namespace", "rule")
+		metrics.NewGaugeVecFunc("sentinel_namespace_scan_seconds", "Time YARA spent per rule namespace since the rules were loaded.", func(emit func(float64, ...string)) {
+			for _, c := range scan.SlowRules(0).Namespaces {
+				emit(c.Cost.Seconds(), c.Namespace)
+			}
+		}, "namespace")
+	}
+	metricsServer := metrics.Start(cfg)
+
+	// Signed bundles replace the rules in place once they compile
+	updates, err := updater.New(cfg, st.reloadRules)
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to set up signature updates")
+	}
+	st.updates = updates
+	if updates != nil {
+		updates.Start()
+	}
+
+	ctl := control.NewServer(cfg)
+	registerControlCommands(ctl, st, store)
+	if err := ctl.Start(); err != nil {
+		logger.Log.WithError(err).Warn("Control socket unavailable")
+	}
+	apiServer := api.Start(cfg, ctl, records)
+
+	// Wait for shutdown, reloading the config on SIGHUP
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
 	logger.Log.Info("Anti-Abuse is running. Press Ctrl+C to stop.")
 
-	<-sigChan
+	// Rules and watches are loaded; tell systemd and keep its watchdog fed
+	stopNotify := make(chan struct{})
+	go notifySystemd(st, stopNotify)
+
+	for running := true; running; {
+		select {
+		case <-hupChan:
+			_ = sdnotify.Reloading()
+			_ = st.reloadConfig()
+			_ = sdnotify.Ready()
+		case <-sigChan:
+			running = false
+		}
+	}
+	close(stopNotify)
+	_ = sdnotify.Stopping()
 	logger.Log.Info("Shutting down...")
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -117,15 +237,238 @@ func runForeground() {
 	_ = shutdownCtx
 
 	// Stop watcher
+	apiServer.Stop()
+	ctl.Stop()
+	updates.Stop()
+	metricsServer.Stop()
 	watch.Stop()
+	records.Close()
+	box.Stop()
 
 	logger.Log.Info("Shutdown complete")
 }
 
+// runtimeState is what signal handling and the control socket share. The
+// mutex serializes reloads.
+type runtimeState struct {
+	mu      sync.Mutex
+	cfg     *config.Config
+	watch   *watcher.Watcher
+	scan    *scanner.Scanner
+	updates *updater.Updater // Nil when signature updates are disabled
+	started time.Time
+}
+
+func (st *runtimeState) config() *config.Config {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.cfg
+}
+
+// reloadConfig re-reads and validates the config file and applies it to the
+// watcher and plugins. The current config stays active, and is re-applied if
+// it was partially replaced, when anything fails.
+func (st *runtimeState) reloadConfig() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	logger.Log.Infof("Reloading config from %s", *configPath)
+
+	current := st.cfg
+	cfg, err := config.LoadConfig(*configPath)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		logger.Log.WithError(err).Error("Config reload rejected, keeping current config")
+		return err
+	}
+
+	if err := st.watch.Reload(cfg); err != nil {
+		logger.Log.WithError(err).Error("Config reload rejected, keeping current config")
+		return err
+	}
+	if err := plugins.InitPlugins(cfg); err != nil {
+		logger.Log.WithError(err).Error("Plugins rejected the new config, rolling back")
+		if err := st.watch.Reload(current); err != nil {
+			logger.Log.WithError(err).Error("Failed to restore watcher config")
+		}
+		if err := plugins.InitPlugins(current); err != nil {
+			logger.Log.WithError(err).Error("Failed to restore plugin config")
+		}
+		return err
+	}
+
+	if st.scan.SetProfiles(scanProfiles(cfg)) {
+		// Rules are grouped by the namespaces the profiles select
+		logger.Log.Info("Scan profile namespaces changed, reloading rules")
+		if err := st.scan.ReloadRules(updater.ActivePath(cfg)); err != nil {
+			logger.Log.WithError(err).Error("Rules reload failed")
+		}
+	}
+	st.scan.SetHeuristics(heuristics(cfg))
+	if cfg.Detection.SignaturePath != current.Detection.SignaturePath {
+		logger.Log.Warn("SignaturePath changes take effect on the next rules reload")
+	}
+	if cfg.Detection.RuleCachePath != current.Detection.RuleCachePath || cfg.Detection.StrictRules != current.Detection.StrictRules ||
+		cfg.Detection.Profiling != current.Detection.Profiling {
+		logger.Log.Warn("ruleCachePath, strictRules and DETECTION.PROFILING changes take effect after a restart")
+	}
+	if cfg.Outbox != current.Outbox || cfg.Quarantine != current.Quarantine || cfg.History != current.History || cfg.Control != current.Control ||
+		cfg.Metrics != current.Metrics || cfg.API != current.API || cfg.Fleet.ServerURL != current.Fleet.ServerURL ||
+		cfg.Fleet.Token != current.Fleet.Token || cfg.Fleet.CAFile != current.Fleet.CAFile || cfg.Updates != current.Updates {
+		logger.Log.Warn("OUTBOX, QUARANTINE, HISTORY, CONTROL, METRICS, API, FLEET and UPDATES changes take effect after a restart")
+	}
+
+	st.cfg = cfg
+	logger.Log.Info("Config reloaded")
+	return nil
+}
+
+// scannerOptions reads the rule loading and profiling settings.
+func scannerOptions(cfg *config.Config) scanner.Options {
+	profiling := cfg.Detection.Profiling
+	return scanner.Options{
+		CacheDir:         cfg.Detection.RuleCachePath,
+		Strict:           cfg.Detection.StrictRules,
+		Profile:          profiling.Enabled,
+		RuleBudget:       time.Duration(profiling.BudgetMs) * time.Millisecond,
+		DisableSlowRules: profiling.Action == "disable",
+		Profiles:         scanProfiles(cfg),
+		Heuristics:       heuristics(cfg),
+	}
+}
+
+// warnUnratedRules warns about YARA rules without a severity. Before the
+// decision rules every match suspended the server; with the default rules
+// such matches only alert.
+func warnUnratedRules(scan *scanner.Scanner) {
+	rules := scan.Rules()
+	var unrated []string
+	for _, rule := range rules {
+		if rule.Severity == "" {
+			unrated = append(unrated, rule.Namespace+":"+rule.Name)
+		}
+	}
+	if len(unrated) == 0 {
+		return
+	}
+	logger.Log.Warnf("%d of %d YARA rules have no severity meta or tag, so their matches alert but do not suspend with the default decision rules", len(unrated), len(rules))
+	logger.Log.Debugf("Rules without severity: %s", strings.Join(unrated, ", "))
+}
+
+// heuristics reads the packer and entropy check settings.
+func heuristics(cfg *config.Config) scanner.Heuristics {
+	h := cfg.Detection.Heuristics
+	return scanner.Heuristics{
+		Enabled:          h.Enabled,
+		EntropyThreshold: h.EntropyThreshold,
+		MinSectionSize:   h.MinSectionKB * 1024,
+		TrustedPaths:     h.TrustedPaths,
+		Severity:         h.Severity,
+	}
+}
+
+// scanProfiles converts the configured scan profiles and adds a catch-all
+// profile carrying the global file size limit.
+func scanProfiles(cfg *config.Config) []scanner.ScanProfile {
+	const mb = 1024 * 1024
+	maxFileSize := int64(cfg.Detection.MaxFileSizeMB) * mb
+	profiles := make([]scanner.ScanProfile, 0, len(cfg.Detection.Profiles)+1)
+	for _, p := range cfg.Detection.Profiles {
+		profile := scanner.ScanProfile{
+			Name:         p.Name,
+			Paths:        p.Paths,
+			Timeout:      time.Duration(p.TimeoutSeconds) * time.Second,
+			MaxFileSize:  int64(p.MaxFileSizeMB) * mb,
+			MaxEntrySize: int64(p.MaxEntrySizeMB) * mb,
+			ArchiveDepth: p.ArchiveDepth,
+			Namespaces:   p.Namespaces,
+			FastMode:     p.FastMode,
+			DisableAI:    p.DisableAI,
+		}
+		if profile.MaxFileSize == 0 {
+			profile.MaxFileSize = maxFileSize
+		}
+		profiles = append(profiles, profile)
+	}
+	return append(profiles, scanner.ScanProfile{Name: "default", MaxFileSize: maxFileSize})
+}
+
+// profilingTop is the number of slow rules reported.
+func profilingTop(cfg *config.Config) int {
+	if top := cfg.Detection.Profiling.Top; top > 0 {
+		return top
+	}
+	return 20
+}
+
+// reloadRules recompiles the YARA rules from the active bundle or the
+// configured signature path.
+func (st *runtimeState) reloadRules() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err := st.scan.ReloadRules(updater.ActivePath(st.cfg)); err != nil {
+		logger.Log.WithError(err).Error("Rules reload failed")
+		return err
+	}
+	return nil
+}
+
+// notifySystemd reports readiness and live counters to systemd. Watchdog
+// heartbeats are only sent while the watcher event loop keeps ticking, so a
+// wedged watcher is restarted by systemd.
+func notifySystemd(st *runtimeState, stop <-chan struct{}) {
+	if err := sdnotify.Ready(); err != nil {
+		logger.Log.WithError(err).Warn("Failed to notify systemd")
+	}
+
+	interval := sdnotify.WatchdogInterval()
+	tick := 10 * time.Second
+	if interval > 0 && interval/2 < tick {
+		tick = interval / 2
+	}
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	}
+	// The event loop ticks once a second, so it is only stale after two
+	stale := interval / 2
+	if stale < 2*time.Second {
+		stale = 2 * time.Second
+	}
+	if interval > 0 && interval < 2*time.Second {
+		logger.Log.Warnf("Watchdog interval %s is shorter than the event loop tick allows, heartbeats may be late", interval)
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			status := st.watch.Status()
+			text := fmt.Sprintf("Watching %d dirs, %d rules, queue %d/%d, AI queue %d",
+				status.WatchedDirs, status.RulesLoaded, status.QueueDepth, status.QueueCapacity, status.AIQueueDepth)
+			if status.Paused {
+				text += ", paused"
+			}
+			_ = sdnotify.Status(text)
+
+			if interval == 0 {
+				continue
+			}
+			if since := time.Since(status.LastHeartbeat); since > stale {
+				logger.Log.Warnf("Event loop has not ticked for %s, withholding watchdog heartbeat", since.Round(time.Second))
+				continue
+			}
+			_ = sdnotify.Watchdog()
+		case <-stop:
+			return
+		}
+	}
+}
+
 func runDaemon() {
 	// Daemon mode - redirect logs to file
-	logFile := "/var/log/sentinel/sentinel.log"
-	if err := logger.SetLogFile(logFile); err != nil {
+	if err := logger.SetLogFile(daemon.LogFile); err != nil {
 		logger.Log.WithError(err).Fatal("Failed to set log file")
 	}
 
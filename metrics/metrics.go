@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default histogram buckets in seconds
+var (
+	LatencyBuckets   = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	AILatencyBuckets = []float64{.5, 1, 2, 5, 10, 20, 30, 60, 120}
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteAll(w)
+	})
+}
+
+// WriteAll writes every registered metric in the Prometheus text format.
+func WriteAll(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMu.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+// key joins label values into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString renders {a="x",b="y"} for a key, with extra pairs appended.
+func (d *desc) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, d.labels[i], labelEscaper.Replace(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value per label set.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts observations into cumulative buckets per label set.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), s.count)
+	}
+}
+
+// GaugeFunc reports a value read at scrape time.
+type GaugeFunc struct {
+	desc
+	fn func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name: name, help: help}, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.fn()))
+}
+
+// GaugeVecFunc reports labelled values read at scrape time. The function
+// calls emit once per label set.
+type GaugeVecFunc struct {
+	desc
+	fn func(emit func(v float64, labelValues ...string))
+}
+
+func NewGaugeVecFunc(name, help string, fn func(emit func(v float64, labelValues ...string)), labels ...string) *GaugeVecFunc {
+	g := &GaugeVecFunc{desc: desc{name, help, labels}, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeVecFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	g.fn(func(v float64, labelValues ...string) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(g.key(labelValues)), formatFloat(v))
+	})
+}
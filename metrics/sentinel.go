@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+// Metrics recorded across Sentinel
+var (
+	EventsReceived     = NewCounter("sentinel_events_received_total", "File system events received, by operation.", "op")
+	EventsDropped      = NewCounter("sentinel_events_dropped_total", "File events dropped because the work queue was full.")
+	FilesScanned       = NewCounter("sentinel_files_scanned_total", "Files scanned with YARA.")
+	BytesScanned       = NewCounter("sentinel_bytes_scanned_total", "Bytes scanned with YARA.")
+	ScanDuration       = NewHistogram("sentinel_scan_duration_seconds", "Time to scan one file with all rules.", LatencyBuckets)
+	YaraTimeouts       = NewCounter("sentinel_yara_timeouts_total", "YARA scans aborted by the scan timeout.")
+	RuleBudgetExceeded = NewCounter("sentinel_rule_budget_exceeded_total", "Scans in which a YARA rule used more than the profiling budget, by rule.", "rule")
+	Detections         = NewCounter("sentinel_detections_total", "YARA rule matches, by rule.", "rule")
+	Notifications      = NewCounter("sentinel_notifications_total", "Alert deliveries, by notifier and result.", "notifier", "result")
+	PluginActions      = NewCounter("sentinel_plugin_actions_total", "Plugin calls for decided detections, by plugin and result.", "plugin", "result")
+	AIDuration         = NewHistogram("sentinel_ai_request_duration_seconds", "AI provider request latency, by provider and result.", AILatencyBuckets, "provider", "result")
+)
+
+// Server exposes the registered metrics over HTTP.
+type Server struct {
+	srv *http.Server
+}
+
+// Start serves the metrics endpoint when enabled in the config. It returns
+// nil when metrics are disabled.
+func Start(cfg *config.Config) *Server {
+	if !cfg.Metrics.Enabled {
+		return nil
+	}
+
+	listen := "127.0.0.1:9108"
+	if cfg.Metrics.Listen != "" {
+		listen = cfg.Metrics.Listen
+	}
+	path := "/metrics"
+	if cfg.Metrics.Path != "" {
+		path = cfg.Metrics.Path
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, Handler())
+	s := &Server{srv: &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}}
+
+	go func() {
+		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Log.WithError(err).Error("Metrics endpoint failed")
+		}
+	}()
+	logger.Log.Infof("Metrics available at http://%s%s", listen, path)
+	return s
+}
+
+func (s *Server) Stop() {
+	if s == nil {
+		return
+	}
+	_ = s.srv.Close()
+}
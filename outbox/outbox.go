@@ -0,0 +1,386 @@
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+const (
+	StatePending = "pending"
+	StateDead    = "dead"
+)
+
+// Entry is a single outbound delivery persisted on disk until it succeeds
+// or runs out of attempts.
+type Entry struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+}
+
+// Handler delivers the payload of an entry. Returning an error schedules a retry.
+type Handler func(payload json.RawMessage) error
+
+var (
+	handlers   = make(map[string]Handler)
+	handlersMu sync.RWMutex
+
+	defaultOutbox *Outbox
+)
+
+// RegisterHandler sets the delivery function for entries of the given kind.
+func RegisterHandler(kind string, h Handler) {
+	handlersMu.Lock()
+	handlers[kind] = h
+	handlersMu.Unlock()
+}
+
+func getHandler(kind string) (Handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	h, ok := handlers[kind]
+	return h, ok
+}
+
+// SetDefault sets the outbox used by the package-level Enqueue.
+func SetDefault(o *Outbox) {
+	defaultOutbox = o
+}
+
+// Enqueue persists a delivery in the default outbox.
+func Enqueue(kind string, payload interface{}) error {
+	if defaultOutbox == nil {
+		return fmt.Errorf("outbox not initialized")
+	}
+	return defaultOutbox.Enqueue(kind, payload)
+}
+
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error as not worth retrying; the entry goes straight to
+// the dead-letter directory.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+type Outbox struct {
+	dir         string
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+
+	mu   sync.Mutex
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func Open(cfg *config.Config) (*Outbox, error) {
+	o := &Outbox{
+		dir:         "/var/lib/sentinel/outbox",
+		maxAttempts: 10,
+		baseDelay:   5 * time.Second,
+		maxDelay:    time.Hour,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	if cfg.Outbox.Path != "" {
+		o.dir = cfg.Outbox.Path
+	}
+	if cfg.Outbox.MaxAttempts > 0 {
+		o.maxAttempts = cfg.Outbox.MaxAttempts
+	}
+	if cfg.Outbox.BaseDelaySeconds > 0 {
+		o.baseDelay = time.Duration(cfg.Outbox.BaseDelaySeconds) * time.Second
+	}
+	if cfg.Outbox.MaxDelaySeconds > 0 {
+		o.maxDelay = time.Duration(cfg.Outbox.MaxDelaySeconds) * time.Second
+	}
+
+	for _, state := range []string{StatePending, StateDead} {
+		if err := os.MkdirAll(filepath.Join(o.dir, state), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create outbox directory: %w", err)
+		}
+	}
+	return o, nil
+}
+
+func (o *Outbox) Enqueue(kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	entry := &Entry{
+		ID:          newID(now),
+		Kind:        kind,
+		Payload:     data,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+
+	o.mu.Lock()
+	err = o.write(StatePending, entry)
+	o.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	logger.Log.Debugf("Queued %s delivery %s", kind, entry.ID)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start replays pending entries left over from a previous run and keeps
+// delivering new ones until Stop is called.
+func (o *Outbox) Start() {
+	if entries, err := o.List(StatePending); err == nil && len(entries) > 0 {
+		logger.Log.Infof("Replaying %d pending outbox deliveries", len(entries))
+	}
+
+	o.wg.Add(1)
+	go o.loop()
+}
+
+func (o *Outbox) Stop() {
+	close(o.stop)
+	o.wg.Wait()
+}
+
+func (o *Outbox) loop() {
+	defer o.wg.Done()
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		case <-o.stop:
+			return
+		}
+		o.processDue()
+	}
+}
+
+func (o *Outbox) processDue() {
+	entries, err := o.List(StatePending)
+	if err != nil {
+		logger.Log.WithError(err).Warn("Failed to read outbox")
+		return
+	}
+
+	now := time.Now()
+	for i := range entries {
+		select {
+		case <-o.stop:
+			return
+		default:
+		}
+		if entries[i].NextAttempt.After(now) {
+			continue
+		}
+		o.deliver(&entries[i])
+	}
+}
+
+func (o *Outbox) deliver(entry *Entry) {
+	handler, ok := getHandler(entry.Kind)
+	if !ok {
+		err := fmt.Errorf("no handler registered for %s", entry.Kind)
+		o.fail(entry, err)
+		return
+	}
+
+	err := handler(entry.Payload)
+	if err == nil {
+		o.mu.Lock()
+		_ = os.Remove(o.path(StatePending, entry.ID))
+		o.mu.Unlock()
+		logger.Log.Debugf("Delivered %s %s after %d retries", entry.Kind, entry.ID, entry.Attempts)
+		return
+	}
+
+	var retry interface{ RetryAfter() time.Duration }
+	if errors.As(err, &retry) {
+		entry.LastError = err.Error()
+		entry.NextAttempt = time.Now().Add(retry.RetryAfter())
+		o.mu.Lock()
+		_ = o.write(StatePending, entry)
+		o.mu.Unlock()
+		return
+	}
+
+	o.fail(entry, err)
+}
+
+func (o *Outbox) fail(entry *Entry, err error) {
+	entry.Attempts++
+	entry.LastError = err.Error()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || entry.Attempts >= o.maxAttempts {
+		logger.Log.WithError(err).Warnf("Outbox delivery %s (%s) failed after %d attempts, moved to dead letters", entry.ID, entry.Kind, entry.Attempts)
+		if err := o.write(StateDead, entry); err != nil {
+			logger.Log.WithError(err).Error("Failed to write dead letter")
+			return
+		}
+		_ = os.Remove(o.path(StatePending, entry.ID))
+		return
+	}
+
+	entry.NextAttempt = time.Now().Add(o.backoff(entry.Attempts))
+	logger.Log.WithError(err).Warnf("Outbox delivery %s (%s) failed, retrying at %s", entry.ID, entry.Kind, entry.NextAttempt.Format("15:04:05"))
+	_ = o.write(StatePending, entry)
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.baseDelay
+	for i := 1; i < attempts && delay < o.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > o.maxDelay {
+		delay = o.maxDelay
+	}
+	return delay
+}
+
+// List returns the entries in the given state, oldest first.
+func (o *Outbox) List(state string) ([]Entry, error) {
+	if state != StatePending && state != StateDead {
+		return nil, fmt.Errorf("unknown outbox state %q", state)
+	}
+	files, err := os.ReadDir(filepath.Join(o.dir, state))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(o.dir, state, file.Name()))
+		if err != nil {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			logger.Log.WithError(err).Warnf("Skipping corrupt outbox entry %s", file.Name())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
+
+// Retry moves a dead entry back to pending, or makes a pending entry due now.
+func (o *Outbox) Retry(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, state := range []string{StateDead, StatePending} {
+		data, err := os.ReadFile(o.path(state, id))
+		if err != nil {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		entry.Attempts = 0
+		entry.NextAttempt = time.Now()
+		if err := o.write(StatePending, &entry); err != nil {
+			return err
+		}
+		if state == StateDead {
+			_ = os.Remove(o.path(StateDead, id))
+		}
+		return nil
+	}
+	return fmt.Errorf("outbox entry %s not found", id)
+}
+
+// RetryAll requeues every dead entry and returns how many were moved.
+func (o *Outbox) RetryAll() (int, error) {
+	entries, err := o.List(StateDead)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if err := o.Retry(entry.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// Purge deletes every entry in the given state and returns how many were removed.
+func (o *Outbox) Purge(state string) (int, error) {
+	entries, err := o.List(state)
+	if err != nil {
+		return 0, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, entry := range entries {
+		if err := os.Remove(o.path(state, entry.ID)); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+func (o *Outbox) write(state string, entry *Entry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first so a crash never leaves a half-written entry
+	tmp := o.path(state, entry.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path(state, entry.ID))
+}
+
+func (o *Outbox) path(state, id string) string {
+	return filepath.Join(o.dir, state, id+".json")
+}
+
+func newID(now time.Time) string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(b[:]))
+}
@@ -2,13 +2,14 @@ package plugins
 
 import (
 	"anti-abuse-go/config"
+	"anti-abuse-go/decision"
 )
 
 type Plugin interface {
 	Name() string
 	Version() string
 	OnStart(cfg *config.Config) error
-	OnDetected(path string, matches interface{}) error
+	OnDetected(path string, verdict *decision.Verdict) error // Called once the verdict is final
 	OnScan(path string, content []byte, eventType string) error
 }
 
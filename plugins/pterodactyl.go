@@ -5,20 +5,32 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"path/filepath"
-	"regexp"
-	"strings"
+	"sync/atomic"
 
 	"anti-abuse-go/config"
+	"anti-abuse-go/decision"
 	"anti-abuse-go/logger"
+	"anti-abuse-go/outbox"
+	"anti-abuse-go/serverid"
 )
 
+const suspendOutboxKind = "pterodactyl.suspend"
+
 type PterodactylAutoSuspend struct {
-	cfg *config.Config
+	// Replaced on config reload while workers and the outbox read it
+	cfg atomic.Pointer[config.Config]
+}
+
+// suspendAction is the outbox payload for a suspension that failed and is retried later.
+type suspendAction struct {
+	UUID string `json:"uuid"`
+	Path string `json:"path"`
 }
 
 func init() {
-	RegisterPlugin(&PterodactylAutoSuspend{})
+	p := &PterodactylAutoSuspend{}
+	RegisterPlugin(p)
+	outbox.RegisterHandler(suspendOutboxKind, p.retrySuspend)
 }
 
 func (p *PterodactylAutoSuspend) Name() string {
@@ -30,7 +42,7 @@ func (p *PterodactylAutoSuspend) Version() string {
 }
 
 func (p *PterodactylAutoSuspend) OnStart(cfg *config.Config) error {
-	p.cfg = cfg
+	p.cfg.Store(cfg)
 	
 	// Check if plugin is enabled and configured
 	if !cfg.Plugins.PterodactylAutoSuspend.Enabled {
@@ -47,24 +59,48 @@ func (p *PterodactylAutoSuspend) OnStart(cfg *config.Config) error {
 	return nil
 }
 
-func (p *PterodactylAutoSuspend) OnDetected(path string, matches interface{}) error {
+func (p *PterodactylAutoSuspend) OnDetected(path string, verdict *decision.Verdict) error {
 	// Double-check plugin is enabled (in case config changed at runtime)
-	if !p.cfg.Plugins.PterodactylAutoSuspend.Enabled {
+	cfg := p.cfg.Load()
+	if cfg == nil || !cfg.Plugins.PterodactylAutoSuspend.Enabled {
+		return nil
+	}
+	if verdict.Action != decision.ActionSuspend {
 		return nil
 	}
 	
-	uuid := p.extractUUID(path)
+	uuid := serverid.FromPath(path)
 	if uuid == "" {
 		return nil
 	}
 
-	serverID, err := p.getServerID(uuid)
+	if err := p.suspend(cfg, uuid); err != nil {
+		logger.Log.WithError(err).Errorf("Failed to suspend server %s, queueing for retry", uuid)
+		if qerr := outbox.Enqueue(suspendOutboxKind, suspendAction{UUID: uuid, Path: path}); qerr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PterodactylAutoSuspend) suspend(cfg *config.Config, uuid string) error {
+	serverID, err := p.getServerID(cfg, uuid)
 	if err != nil {
-		logger.Log.WithError(err).Error("Failed to get server ID")
 		return err
 	}
+	return p.suspendServer(cfg, serverID)
+}
 
-	return p.suspendServer(serverID)
+func (p *PterodactylAutoSuspend) retrySuspend(payload json.RawMessage) error {
+	var action suspendAction
+	if err := json.Unmarshal(payload, &action); err != nil {
+		return outbox.Permanent(err)
+	}
+	cfg := p.cfg.Load()
+	if cfg == nil || !cfg.Plugins.PterodactylAutoSuspend.Enabled {
+		return outbox.Permanent(fmt.Errorf("plugin disabled"))
+	}
+	return p.suspend(cfg, action.UUID)
 }
 
 func (p *PterodactylAutoSuspend) OnScan(path string, content []byte, eventType string) error {
@@ -72,29 +108,14 @@ func (p *PterodactylAutoSuspend) OnScan(path string, content []byte, eventType s
 	return nil
 }
 
-var uuidRegex = regexp.MustCompile(`^[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}$`)
-
-func (p *PterodactylAutoSuspend) extractUUID(path string) string {
-	// Extract UUID from path like /var/lib/pterodactyl/volumes/uuid/...
-	parts := strings.Split(path, string(filepath.Separator))
-	for i, part := range parts {
-		if uuidRegex.MatchString(part) {
-			if i+1 < len(parts) {
-				return part
-			}
-		}
-	}
-	return ""
-}
-
-func (p *PterodactylAutoSuspend) getServerID(uuid string) (int, error) {
-	url := fmt.Sprintf("%s/api/application/servers?filter[uuid]=%s", p.cfg.Plugins.PterodactylAutoSuspend.Hostname, uuid)
+func (p *PterodactylAutoSuspend) getServerID(cfg *config.Config, uuid string) (int, error) {
+	url := fmt.Sprintf("%s/api/application/servers?filter[uuid]=%s", cfg.Plugins.PterodactylAutoSuspend.Hostname, uuid)
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return 0, err
 	}
-	req.Header.Set("Authorization", "Bearer "+p.cfg.Plugins.PterodactylAutoSuspend.APIKey)
+	req.Header.Set("Authorization", "Bearer "+cfg.Plugins.PterodactylAutoSuspend.APIKey)
 	req.Header.Set("Accept", "application/json")
 
 	client := &http.Client{}
@@ -121,20 +142,20 @@ func (p *PterodactylAutoSuspend) getServerID(uuid string) (int, error) {
 	}
 
 	if len(data.Data) == 0 {
-		return 0, fmt.Errorf("no server found for UUID %s", uuid)
+		return 0, outbox.Permanent(fmt.Errorf("no server found for UUID %s", uuid))
 	}
 
 	return data.Data[0].Attributes.ID, nil
 }
 
-func (p *PterodactylAutoSuspend) suspendServer(serverID int) error {
-	url := fmt.Sprintf("%s/api/application/servers/%d/suspend", p.cfg.Plugins.PterodactylAutoSuspend.Hostname, serverID)
+func (p *PterodactylAutoSuspend) suspendServer(cfg *config.Config, serverID int) error {
+	url := fmt.Sprintf("%s/api/application/servers/%d/suspend", cfg.Plugins.PterodactylAutoSuspend.Hostname, serverID)
 
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer([]byte{}))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", "Bearer "+p.cfg.Plugins.PterodactylAutoSuspend.APIKey)
+	req.Header.Set("Authorization", "Bearer "+cfg.Plugins.PterodactylAutoSuspend.APIKey)
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
@@ -0,0 +1,80 @@
+package quarantine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Quarantined files live in directories their tenants control, so every
+// path below is opened relative to a directory descriptor and without
+// following symlinks. A directory swapped for a symlink fails the open
+// instead of sending root elsewhere.
+
+// openDir opens an absolute directory one component at a time. With create
+// set, missing components are made with mode 0755.
+func openDir(dir string, create bool) (*os.File, error) {
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("%s is not an absolute path", dir)
+	}
+	fd, err := syscall.Open("/", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(filepath.Clean(dir), "/") {
+		if name == "" {
+			continue
+		}
+		if create {
+			if err := syscall.Mkdirat(fd, name, 0755); err != nil && err != syscall.EEXIST {
+				syscall.Close(fd)
+				return nil, &os.PathError{Op: "mkdir", Path: dir, Err: err}
+			}
+		}
+		next, err := syscall.Openat(fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		syscall.Close(fd)
+		if err != nil {
+			if err == syscall.ELOOP || err == syscall.ENOTDIR {
+				return nil, fmt.Errorf("%s: %s is not a directory or is a symlink", dir, name)
+			}
+			return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+		}
+		fd = next
+	}
+	return os.NewFile(uintptr(fd), dir), nil
+}
+
+// openAt opens name in dir without following a symlink.
+func openAt(dir *os.File, name string, flags int, mode uint32) (*os.File, error) {
+	fd, err := syscall.Openat(int(dir.Fd()), name, flags|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, mode)
+	if err != nil {
+		if err == syscall.ELOOP {
+			return nil, fmt.Errorf("%s is a symlink", filepath.Join(dir.Name(), name))
+		}
+		return nil, &os.PathError{Op: "open", Path: filepath.Join(dir.Name(), name), Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name)), nil
+}
+
+// stat returns the stat of an open file.
+func stat(f *os.File) (*syscall.Stat_t, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		return nil, &os.PathError{Op: "fstat", Path: f.Name(), Err: err}
+	}
+	return &st, nil
+}
+
+// sameFile reports whether name in dir still is the open file f.
+func sameFile(dir *os.File, name string, f *os.File) bool {
+	current, err := openAt(dir, name, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return false
+	}
+	defer current.Close()
+	a, errA := stat(current)
+	b, errB := stat(f)
+	return errA == nil && errB == nil && a.Dev == b.Dev && a.Ino == b.Ino
+}
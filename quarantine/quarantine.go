@@ -0,0 +1,300 @@
+package quarantine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/logger"
+)
+
+// Item describes a quarantined file. The content is kept next to the
+// metadata as <id>.bin, readable by root only.
+type Item struct {
+	ID            string      `json:"id"`
+	OriginalPath  string      `json:"original_path"`
+	SHA256        string      `json:"sha256"`
+	Size          int64       `json:"size"`
+	Mode          os.FileMode `json:"mode"`
+	UID           int         `json:"uid"`
+	GID           int         `json:"gid"`
+	Reason        string      `json:"reason,omitempty"`
+	QuarantinedAt time.Time   `json:"quarantined_at"`
+}
+
+var defaultStore *Store
+
+// SetDefault sets the store used by the package-level File.
+func SetDefault(s *Store) {
+	defaultStore = s
+}
+
+// File quarantines a file in the default store. With expectedSHA256 set
+// the file must still have the content that was scanned.
+func File(path, reason, expectedSHA256 string) (*Item, error) {
+	if defaultStore == nil {
+		return nil, fmt.Errorf("quarantine not initialized")
+	}
+	return defaultStore.Add(path, reason, expectedSHA256)
+}
+
+// Store keeps quarantined files out of reach of the servers that dropped them.
+type Store struct {
+	dir string
+}
+
+func Open(cfg *config.Config) (*Store, error) {
+	dir := "/var/lib/sentinel/quarantine"
+	if cfg.Quarantine.Path != "" {
+		dir = cfg.Quarantine.Path
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Add moves a file into the store and records where it came from. With
+// expectedSHA256 set, a file whose content changed since it was scanned is
+// left alone. Symlinks and files with other hard links are refused so a
+// tenant cannot point root at a host file.
+func (s *Store) Add(path, reason, expectedSHA256 string) (*Item, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// Symlinks above the file, e.g. a volume directory on another disk,
+	// are resolved once; from here on none is followed
+	dirPath, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Base(path)
+	path = filepath.Join(dirPath, name)
+
+	dir, err := openDir(dirPath, false)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	in, err := openAt(dir, name, syscall.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	st, err := stat(in)
+	if err != nil {
+		return nil, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if st.Nlink > 1 {
+		return nil, fmt.Errorf("%s has %d hard links", path, st.Nlink)
+	}
+
+	item := &Item{
+		ID:            newID(),
+		OriginalPath:  path,
+		Size:          st.Size,
+		Mode:          os.FileMode(st.Mode).Perm(),
+		UID:           int(st.Uid),
+		GID:           int(st.Gid),
+		Reason:        reason,
+		QuarantinedAt: time.Now(),
+	}
+
+	content := s.contentPath(item.ID)
+	sum, err := copyFile(in, content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to quarantine %s: %w", path, err)
+	}
+	switch {
+	case expectedSHA256 != "" && sum != expectedSHA256:
+		err = fmt.Errorf("%s changed since it was scanned", path)
+	case !sameFile(dir, name, in):
+		err = fmt.Errorf("%s was replaced while quarantining", path)
+	default:
+		if uerr := syscall.Unlinkat(int(dir.Fd()), name); uerr != nil {
+			err = fmt.Errorf("failed to remove %s: %w", path, uerr)
+		}
+	}
+	if err != nil {
+		os.Remove(content)
+		return nil, err
+	}
+	item.SHA256 = sum
+
+	if err := s.writeItem(item); err != nil {
+		// Put the file back rather than leave it without metadata
+		if rerr := s.writeBack(item); rerr != nil {
+			logger.Log.WithError(rerr).Errorf("Failed to restore %s after quarantine error", path)
+		} else {
+			os.Remove(content)
+		}
+		return nil, err
+	}
+
+	logger.Log.Infof("Quarantined %s as %s", path, item.ID)
+	return item, nil
+}
+
+// List returns the quarantined items, oldest first.
+func (s *Store) List() ([]*Item, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0)
+	for _, file := range files {
+		item, err := s.readItem(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err != nil {
+			logger.Log.WithError(err).Warnf("Skipping unreadable quarantine entry %s", file)
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].QuarantinedAt.Before(items[j].QuarantinedAt) })
+	return items, nil
+}
+
+// Restore moves a quarantined file back to its original path with its
+// original mode and owner. An existing file at that path is never replaced.
+func (s *Store) Restore(id string) (*Item, error) {
+	item, err := s.readItem(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeBack(item); err != nil {
+		return nil, err
+	}
+	_ = os.Remove(s.contentPath(id))
+	_ = os.Remove(s.itemPath(id))
+
+	logger.Log.Infof("Restored %s from quarantine", item.OriginalPath)
+	return item, nil
+}
+
+// Delete removes a quarantined file for good.
+func (s *Store) Delete(id string) error {
+	if _, err := s.readItem(id); err != nil {
+		return err
+	}
+	if err := os.Remove(s.contentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.itemPath(id))
+}
+
+func (s *Store) readItem(id string) (*Item, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid quarantine id %q", id)
+	}
+	data, err := os.ReadFile(s.itemPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("quarantine item %s not found", id)
+		}
+		return nil, err
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (s *Store) writeItem(item *Item) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.itemPath(item.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.itemPath(item.ID))
+}
+
+func (s *Store) itemPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *Store) contentPath(id string) string {
+	return filepath.Join(s.dir, id+".bin")
+}
+
+// writeBack recreates a quarantined file at its original path. Missing
+// directories are created, symlinked ones refused, and mode and owner are
+// set on the open file rather than by path.
+func (s *Store) writeBack(item *Item) error {
+	in, err := os.Open(s.contentPath(item.ID))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	dir, err := openDir(filepath.Dir(item.OriginalPath), true)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	name := filepath.Base(item.OriginalPath)
+	out, err := openAt(dir, name, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("%s already exists", item.OriginalPath)
+		}
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		_ = out.Chmod(item.Mode)
+		_ = out.Chown(item.UID, item.GID)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = syscall.Unlinkat(int(dir.Fd()), name)
+		return err
+	}
+	return nil
+}
+
+// copyFile copies in to a new file dst, readable by root only, and returns
+// the SHA256 of the content.
+func copyFile(in io.Reader, dst string) (string, error) {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b[:]))
+}
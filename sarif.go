@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/scanner"
+	"anti-abuse-go/watcher"
+)
+
+// The subset of SARIF 2.1.0 needed to report YARA matches to code scanning
+// tools.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name    string      `json:"name"`
+	Version string      `json:"version"`
+	Rules   []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     *sarifMessage      `json:"shortDescription,omitempty"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+	Properties           sarifProperties    `json:"properties"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifProperties struct {
+	Namespace string   `json:"namespace,omitempty"`
+	Severity  string   `json:"severity,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           *sarifRegion  `json:"region,omitempty"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	ByteOffset uint64 `json:"byteOffset"`
+}
+
+// sarifLevel maps a rule severity to a SARIF level.
+func sarifLevel(severity string) string {
+	switch severity {
+	case "critical", "high":
+		return "error"
+	case "low":
+		return "note"
+	default:
+		return "warning"
+	}
+}
+
+// fileURI turns a path into the file:// URL SARIF expects, escaping spaces,
+// '#' and '?' that would otherwise break the URI.
+func fileURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// writeSARIF writes the flagged files as a SARIF log. Only rules that
+// matched are listed in the driver.
+func writeSARIF(w io.Writer, flagged []watcher.ScanResult, rules []scanner.RuleInfo) error {
+	infos := make(map[string]scanner.RuleInfo, len(rules))
+	for _, rule := range rules {
+		infos[rule.Name] = rule
+	}
+
+	results := make([]sarifResult, 0)
+	used := make(map[string]bool)
+	for _, f := range flagged {
+		for _, m := range f.Matches {
+			used[m.Rule] = true
+			kind := "YARA rule"
+			if strings.HasPrefix(m.Rule, scanner.HeuristicPrefix) {
+				kind = "Heuristic"
+			}
+			text := fmt.Sprintf("%s %s matched", kind, m.Rule)
+			location := sarifPhysicalLocation{ArtifactLocation: sarifArtifact{URI: fileURI(f.Path)}}
+			if m.Member != "" {
+				text = fmt.Sprintf("%s %s matched archive entry %s", kind, m.Rule, m.Member)
+			} else if len(m.Offsets) > 0 {
+				location.Region = &sarifRegion{ByteOffset: m.Offsets[0]}
+			}
+			results = append(results, sarifResult{
+				RuleID:    m.Rule,
+				Level:     sarifLevel(m.Severity),
+				Message:   sarifMessage{Text: text},
+				Locations: []sarifLocation{{PhysicalLocation: location}},
+			})
+		}
+	}
+
+	driverRules := make([]sarifRule, 0, len(used))
+	for name := range used {
+		info := infos[name]
+		rule := sarifRule{
+			ID:                   name,
+			DefaultConfiguration: sarifConfiguration{Level: sarifLevel(info.Severity)},
+			Properties:           sarifProperties{Namespace: info.Namespace, Severity: info.Severity, Tags: info.Tags},
+		}
+		if description := info.Meta["description"]; description != "" {
+			rule.ShortDescription = &sarifMessage{Text: description}
+		}
+		driverRules = append(driverRules, rule)
+	}
+	sort.Slice(driverRules, func(i, j int) bool { return driverRules[i].ID < driverRules[j].ID })
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool:    sarifTool{Driver: sarifDriver{Name: "sentinel", Version: config.GetVersion(), Rules: driverRules}},
+			Results: results,
+		}},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(log)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/control"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/scanner"
+	"anti-abuse-go/updater"
+	"anti-abuse-go/watcher"
+)
+
+// runScanCommand scans files, directories or stdin once with the configured
+// rules. It exits 0 when nothing is flagged, 1 when something is and 2 on
+// errors.
+func runScanCommand(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	format := fs.String("format", "text", "Output format: text, json or sarif")
+	workers := fs.Int("workers", runtime.NumCPU(), "Files scanned in parallel")
+	rules := fs.String("rules", "", "Rule path, default the active bundle or DETECTION.SignaturePath")
+	name := fs.String("name", "stdin", "File name the rules see for stdin, e.g. upload.jar for archive handling")
+	alert := fs.Bool("alert", false, "Hand flagged files to the running daemon for the normal decision, alert and plugin pipeline")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sentinel scan [flags] <file|dir|->...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 || (*format != "text" && *format != "json" && *format != "sarif") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	cfg := loadConfigOrExit()
+	rulePath := *rules
+	if rulePath == "" {
+		rulePath = updater.ActivePath(cfg)
+	}
+	scan, err := scanner.NewScanner(rulePath, scannerOptions(cfg))
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to load rules")
+	}
+	if scan.RuleCount() == 0 && !cfg.Detection.Heuristics.Enabled {
+		logger.Log.Fatalf("No rules loaded from %s", rulePath)
+	}
+
+	report := &watcher.ScanReport{}
+	var mu sync.Mutex
+	record := func(path string, matches scanner.MatchRules, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			logger.Log.WithError(err).Warnf("Failed to scan %s", path)
+			report.Errors++
+			return
+		}
+		report.Files++
+		if len(matches) > 0 {
+			report.Flagged = append(report.Flagged, watcher.ScanResult{Path: path, Matches: matches})
+		}
+	}
+
+	paths := make(chan string, *workers)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				matches, err := scanFile(scan, path)
+				record(path, matches, err)
+			}
+		}()
+	}
+
+	for _, arg := range fs.Args() {
+		if arg == "-" {
+			maxSize := scan.ScanProfileFor(*name).MaxFileSize
+			content, err := io.ReadAll(io.LimitReader(os.Stdin, maxSize+1))
+			if err == nil && int64(len(content)) > maxSize {
+				err = fmt.Errorf("input too large (max %d bytes)", maxSize)
+			}
+			var matches scanner.MatchRules
+			if err == nil {
+				matches, err = scan.ScanTarget(content, scanner.Target{Path: *name, OwnerUID: -1, Event: "scan"})
+			}
+			record(*name, matches, err)
+			continue
+		}
+		err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				record(path, nil, err)
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				paths <- path
+			}
+			return nil
+		})
+		if err != nil {
+			record(arg, nil, err)
+		}
+	}
+	close(paths)
+	wg.Wait()
+
+	sort.Slice(report.Flagged, func(i, j int) bool { return report.Flagged[i].Path < report.Flagged[j].Path })
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	case "sarif":
+		err = writeSARIF(os.Stdout, report.Flagged, scan.Rules())
+	default:
+		printScanReport(report)
+	}
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to write results")
+	}
+
+	if *alert && len(report.Flagged) > 0 {
+		alertFlagged(cfg, report.Flagged)
+	}
+
+	switch {
+	case report.Errors > 0:
+		os.Exit(2)
+	case len(report.Flagged) > 0:
+		os.Exit(1)
+	}
+}
+
+// scanFile reads and scans one file within the size limit of its scan
+// profile.
+func scanFile(scan *scanner.Scanner, path string) (scanner.MatchRules, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize := scan.ScanProfileFor(path).MaxFileSize; info.Size() > maxSize {
+		return nil, fmt.Errorf("file too large: %d bytes (max %d)", info.Size(), maxSize)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	owner := -1
+	if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+		owner = int(sys.Uid)
+	}
+	return scan.ScanTarget(content, scanner.Target{Path: path, OwnerUID: owner, Event: "scan"})
+}
+
+func printScanReport(report *watcher.ScanReport) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	for _, f := range report.Flagged {
+		rules := make([]string, 0, len(f.Matches))
+		for _, m := range f.Matches {
+			rule := m.Rule
+			if m.Member != "" {
+				rule += " (" + m.Member + ")"
+			}
+			rules = append(rules, rule)
+		}
+		fmt.Fprintf(tw, "FLAGGED\t%s\t%s\n", f.Path, strings.Join(rules, ", "))
+	}
+	fmt.Fprintf(tw, "%d files scanned, %d flagged, %d errors\n", report.Files, len(report.Flagged), report.Errors)
+}
+
+// alertFlagged has the running daemon rescan the flagged files, which runs
+// them through its decision engine, alerts and plugins. Stdin input has no
+// path the daemon could read and is skipped.
+func alertFlagged(cfg *config.Config, flagged []watcher.ScanResult) {
+	socket := control.SocketPath(cfg)
+	for _, f := range flagged {
+		path, err := filepath.Abs(f.Path)
+		if err != nil || !fileExists(path) {
+			logger.Log.Warnf("Not alerting for %s: no file the daemon can read", f.Path)
+			continue
+		}
+		if _, err := control.Call(socket, "scan", path); err != nil {
+			logger.Log.WithError(err).Errorf("Failed to hand %s to the daemon", f.Path)
+		}
+	}
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,162 @@
+package scanner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"anti-abuse-go/logger"
+	"github.com/hillu/go-yara/v4"
+)
+
+const (
+	compiledExt     = ".yarc"
+	reportExt       = ".json"
+	yaraModulePath  = "github.com/hillu/go-yara/v4"
+	defaultCacheDir = "/var/lib/sentinel/rule-cache"
+)
+
+// yaraVersion identifies the libyara headers and go-yara binding the binary
+// was built with. Compiled rules are only valid for the libyara version that
+// wrote them; a cache written by another version fails to load and is
+// rebuilt.
+func yaraVersion() string {
+	binding := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == yaraModulePath {
+				binding = dep.Version
+				if dep.Replace != nil {
+					binding = dep.Replace.Path + "@" + dep.Replace.Version
+				}
+				break
+			}
+		}
+	}
+	return "libyara headers " + yaraHeaderVersion() + ", go-yara " + binding
+}
+
+// cacheKey hashes the YARA version, the declared externals and the path,
+// namespace and content of every source and included file, so any change to
+// the rules or the binary misses the cache.
+func cacheKey(set *ruleSet) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "yara %s\n", yaraVersion())
+	for _, ext := range externals {
+		fmt.Fprintf(h, "external %s %T\n", ext.name, ext.value)
+	}
+	hashFile := func(path, namespace string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%s\x00%s\x00", path, namespace)
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		h.Write([]byte{0})
+		return nil
+	}
+
+	// Compilation order decides which file wins a restart, so it is part of
+	// the key
+	for _, src := range set.sources {
+		if err := hashFile(src.Path, src.Namespace); err != nil {
+			return "", err
+		}
+	}
+	includes := append([]string(nil), set.includes...)
+	sort.Strings(includes)
+	for _, path := range includes {
+		if err := hashFile(path, ""); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadCached returns the cached compilation and its report, or nil rules on
+// a miss.
+func (s *Scanner) loadCached(key string) (*yara.Rules, *CompileReport) {
+	path := filepath.Join(s.cacheDir, key+compiledExt)
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil
+	}
+	var report CompileReport
+	data, err := os.ReadFile(path + reportExt)
+	if err == nil {
+		err = json.Unmarshal(data, &report)
+	}
+	if err != nil {
+		logger.Log.WithError(err).Warn("Discarding compiled rule cache without a report")
+		_ = os.Remove(path)
+		return nil, nil
+	}
+	rules, err := yara.LoadRules(path)
+	if err != nil {
+		logger.Log.WithError(err).Warn("Discarding unreadable compiled rule cache")
+		_ = os.Remove(path)
+		_ = os.Remove(path + reportExt)
+		return nil, nil
+	}
+	return rules, &report
+}
+
+// saveCached stores compiled rules and their report under key.
+func (s *Scanner) saveCached(key string, rules *yara.Rules, report *CompileReport) {
+	if err := os.MkdirAll(s.cacheDir, 0700); err != nil {
+		logger.Log.WithError(err).Warn("Failed to create rule cache directory")
+		return
+	}
+	path := filepath.Join(s.cacheDir, key+compiledExt)
+	data, err := json.Marshal(report)
+	if err == nil {
+		// The report goes first so a cache file never exists without one
+		err = writeFileAtomic(path+reportExt, func(tmp string) error { return os.WriteFile(tmp, data, 0600) })
+	}
+	if err == nil {
+		err = writeFileAtomic(path, rules.Save)
+	}
+	if err != nil {
+		logger.Log.WithError(err).Warn("Failed to write compiled rule cache")
+		return
+	}
+	logger.Log.Debugf("Cached compiled rules in %s", path)
+}
+
+// pruneCache drops the cache files of every key not in keys, the rule
+// groups of the current load.
+func (s *Scanner) pruneCache(keys []string) {
+	keep := make(map[string]bool, 2*len(keys))
+	for _, key := range keys {
+		path := filepath.Join(s.cacheDir, key+compiledExt)
+		keep[path], keep[path+reportExt] = true, true
+	}
+	stale, _ := filepath.Glob(filepath.Join(s.cacheDir, "*"+compiledExt+"*"))
+	for _, file := range stale {
+		if !keep[file] && !strings.HasSuffix(file, ".tmp") {
+			_ = os.Remove(file)
+		}
+	}
+}
+
+func writeFileAtomic(path string, write func(tmp string) error) error {
+	tmp := path + ".tmp"
+	if err := write(tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package scanner
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"anti-abuse-go/serverid"
+	"github.com/hillu/go-yara/v4"
+)
+
+// Target describes the file being scanned. Rules see it through external
+// variables, for example:
+//
+//	condition: $payload and filepath contains "/plugins/" and owner_uid != 0
+type Target struct {
+	Path       string
+	OwnerUID   int      // -1 when unknown
+	ServerUUID string   // Derived from Path when empty
+	WatchRoot  string   // Watched directory the file was found under
+	Event      string   // create, write, rename or scan
+	Profile    *Profile // Collects per-rule scan time when set
+	member     bool
+	scan       *ScanProfile // Resolved from Path on the first scan
+	depth      int          // Archive nesting level
+}
+
+// externals are the variables declared for every compiled rule set, with
+// the values used when a scan does not know better.
+var externals = []struct {
+	name  string
+	value interface{}
+}{
+	{"filename", ""},
+	{"filepath", ""},
+	{"extension", ""}, // Lower case, with the dot
+	{"file_size", 0},  // filesize is a YARA keyword
+	{"owner_uid", -1},
+	{"server_uuid", ""},
+	{"watch_root", ""},
+	{"event_type", ""},
+	{"is_archive_member", false},
+}
+
+func defineExternals(compiler *yara.Compiler) error {
+	for _, ext := range externals {
+		if err := compiler.DefineVariable(ext.name, ext.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variables returns the external variable values for a scan of size bytes.
+func (t Target) variables(size int) map[string]interface{} {
+	serverUUID := t.ServerUUID
+	if serverUUID == "" {
+		serverUUID = serverid.FromPath(t.Path)
+	}
+	return map[string]interface{}{
+		"filename":          filepath.Base(t.Path),
+		"filepath":          t.Path,
+		"extension":         strings.ToLower(filepath.Ext(t.Path)),
+		"file_size":         size,
+		"owner_uid":         t.OwnerUID,
+		"server_uuid":       serverUUID,
+		"watch_root":        t.WatchRoot,
+		"event_type":        t.Event,
+		"is_archive_member": t.member,
+	}
+}
+
+// inArchive returns the target of an archive entry. Its path continues the
+// archive path so path conditions still apply.
+func (t Target) inArchive(name string) Target {
+	t.Path = t.Path + "/" + name
+	t.member = true
+	t.depth++
+	return t
+}
+
+// scanRules scans data with one rule set, setting the externals for target.
+// With profiled set it also returns the time YARA spent per rule.
+func scanRules(rules *yara.Rules, data []byte, target Target, profiled bool) (yara.MatchRules, []yara.RuleProfilingInfo, error) {
+	ys, err := yara.NewScanner(rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ys.Destroy()
+	for name, value := range target.variables(len(data)) {
+		// Precompiled .yarc files may not declare every external
+		_ = ys.DefineVariable(name, value)
+	}
+
+	profile := target.scan
+	if profile == nil {
+		profile = &defaultScanProfile
+	}
+	if profile.FastMode {
+		ys.SetFlags(yara.ScanFlagsFastMode)
+	}
+
+	var matches yara.MatchRules
+	err = ys.SetTimeout(profile.Timeout).SetCallback(&matches).ScanMem(data)
+	if err != nil {
+		if rule := ys.GetLastErrorRule(); rule != nil {
+			err = fmt.Errorf("%w (rule %s:%s)", err, rule.Namespace(), rule.Identifier())
+		}
+	}
+	var infos []yara.RuleProfilingInfo
+	if profiled {
+		infos = ys.GetProfilingInfo()
+	}
+	return matches, infos, err
+}
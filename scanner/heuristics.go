@@ -0,0 +1,240 @@
+package scanner
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"fmt"
+	"math"
+	"strings"
+
+	"anti-abuse-go/logger"
+)
+
+// HeuristicPrefix starts the rule name of every heuristic match, e.g.
+// heuristic:packer_upx. Heuristic matches belong to the "heuristic"
+// namespace for scan profiles.
+const (
+	HeuristicPrefix    = "heuristic:"
+	heuristicNamespace = "heuristic"
+)
+
+const (
+	defaultEntropyThreshold = 7.2
+	defaultMinSectionSize   = 4 * 1024
+	defaultHeuristicLevel   = "medium"
+	entropyBlockSize        = 64 * 1024 // For ELF files whose headers don't parse
+	// Packer markers are only looked for in the headers and stub, so
+	// binaries that merely contain the strings do not match
+	markerWindow = 4 * 1024
+)
+
+// defaultTrustedPaths are where packed or compressed executables are
+// expected when no trusted paths are configured.
+var defaultTrustedPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/opt", "/snap", "/nix/store"}
+
+// Heuristics configures the checks that run next to YARA and catch packed
+// or encrypted executables that string signatures miss.
+type Heuristics struct {
+	Enabled bool
+	// EntropyThreshold is the Shannon entropy, in bits per byte, above
+	// which an ELF section counts as packed or encrypted, default 7.2.
+	EntropyThreshold float64
+	// MinSectionSize skips smaller sections, whose entropy says little,
+	// default 4KB.
+	MinSectionSize int
+	// TrustedPaths are paths or glob patterns where high-entropy ELF files
+	// are not flagged, default the system binary and library directories.
+	TrustedPaths []string
+	// Severity of heuristic matches, default medium so that, with the
+	// default decision rules, a heuristic alone alerts but does not suspend.
+	Severity string
+}
+
+func (h Heuristics) withDefaults() Heuristics {
+	if h.EntropyThreshold <= 0 {
+		h.EntropyThreshold = defaultEntropyThreshold
+	}
+	if h.MinSectionSize <= 0 {
+		h.MinSectionSize = defaultMinSectionSize
+	}
+	if len(h.TrustedPaths) == 0 {
+		h.TrustedPaths = defaultTrustedPaths
+	}
+	if !severityLevels[h.Severity] {
+		h.Severity = defaultHeuristicLevel
+	}
+	return h
+}
+
+// SetHeuristics replaces the heuristic settings.
+func (s *Scanner) SetHeuristics(h Heuristics) {
+	h = h.withDefaults()
+	s.mu.Lock()
+	s.heuristics = h
+	s.mu.Unlock()
+}
+
+// packers are identified by section names or by markers near the start of
+// an executable.
+var packers = []struct {
+	name     string
+	sections []string
+	markers  []string
+}{
+	{"upx", []string{"UPX0", "UPX1", "UPX2", ".upx0", ".upx1"}, []string{"UPX!", "This file is packed with the UPX"}},
+	{"mpress", []string{".MPRESS1", ".MPRESS2"}, nil},
+	{"aspack", []string{".aspack", ".adata"}, nil},
+	{"petite", []string{".petite"}, nil},
+	{"pecompact", []string{"PEC2TO", "PEC2MO"}, []string{"PECompact2"}},
+	{"themida", []string{".themida", ".winlice"}, nil},
+}
+
+// region is a part of an executable whose entropy is measured.
+type region struct {
+	name   string
+	offset uint64
+	data   []byte
+}
+
+// analyze runs the heuristics over an ELF or PE file. Other files are left
+// to YARA.
+func (h Heuristics) analyze(data []byte, path string) MatchRules {
+	var sections []string
+	var regions []region
+	isELF := bytes.HasPrefix(data, []byte(elf.ELFMAG))
+	switch {
+	case isELF:
+		sections, regions = elfRegions(data)
+	case bytes.HasPrefix(data, []byte("MZ")):
+		if f, err := pe.NewFile(bytes.NewReader(data)); err == nil {
+			for _, section := range f.Sections {
+				sections = append(sections, section.Name)
+			}
+			f.Close()
+		}
+	default:
+		return nil
+	}
+
+	var matches MatchRules
+	for _, packer := range packers {
+		if offset, ok := findPacker(data, sections, packer.sections, packer.markers); ok {
+			matches = append(matches, Match{
+				Rule:      HeuristicPrefix + "packer_" + packer.name,
+				Namespace: heuristicNamespace,
+				Tags:      "heuristic,packer",
+				Offsets:   offset,
+				Severity:  h.Severity,
+			})
+		}
+	}
+
+	// Packed ELF files outside the usual places are the miner pattern
+	if isELF && !matchPath(h.TrustedPaths, path) {
+		best, bestEntropy := region{}, 0.0
+		for _, r := range regions {
+			if len(r.data) < h.MinSectionSize {
+				continue
+			}
+			if e := entropy(r.data); e > bestEntropy {
+				best, bestEntropy = r, e
+			}
+		}
+		if bestEntropy >= h.EntropyThreshold {
+			logger.Log.Debugf("%s: %s has entropy %.2f (threshold %.2f)", path, best.name, bestEntropy, h.EntropyThreshold)
+			matches = append(matches, Match{
+				Rule:      HeuristicPrefix + "high_entropy_elf",
+				Namespace: heuristicNamespace,
+				Tags:      fmt.Sprintf("heuristic,entropy,%s=%.2f", best.name, bestEntropy),
+				Offsets:   []uint64{best.offset},
+				Severity:  h.Severity,
+			})
+		}
+	}
+	return matches
+}
+
+// elfRegions returns the section names and the parts of an ELF file to
+// measure: its sections, else its loadable segments, which is all packers
+// like UPX leave, else fixed blocks when the headers are mangled.
+func elfRegions(data []byte) ([]string, []region) {
+	size := uint64(len(data))
+	var names []string
+	var regions []region
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err == nil {
+		defer f.Close()
+		for _, section := range f.Sections {
+			names = append(names, section.Name)
+			// Debug data is often compressed and never loaded
+			if section.Flags&elf.SHF_ALLOC == 0 || section.Type == elf.SHT_NOBITS || section.Offset+section.Size > size || section.Offset+section.Size < section.Offset {
+				continue
+			}
+			regions = append(regions, region{section.Name, section.Offset, data[section.Offset : section.Offset+section.Size]})
+		}
+		if len(regions) > 0 {
+			return names, regions
+		}
+		for i, prog := range f.Progs {
+			if prog.Type != elf.PT_LOAD || prog.Off+prog.Filesz > size || prog.Off+prog.Filesz < prog.Off {
+				continue
+			}
+			regions = append(regions, region{fmt.Sprintf("segment%d", i), prog.Off, data[prog.Off : prog.Off+prog.Filesz]})
+		}
+		if len(regions) > 0 {
+			return names, regions
+		}
+	}
+	for offset := uint64(0); offset < size; offset += entropyBlockSize {
+		end := offset + entropyBlockSize
+		if end > size {
+			end = size
+		}
+		regions = append(regions, region{fmt.Sprintf("block@%d", offset), offset, data[offset:end]})
+	}
+	return names, regions
+}
+
+// findPacker looks for a packer by section name, then by marker, and
+// returns the marker offset when one was found.
+func findPacker(data []byte, sections, names, markers []string) ([]uint64, bool) {
+	for _, section := range sections {
+		for _, name := range names {
+			if strings.EqualFold(section, name) {
+				return nil, true
+			}
+		}
+	}
+	if len(data) > markerWindow {
+		data = data[:markerWindow]
+	}
+	for _, marker := range markers {
+		if i := bytes.Index(data, []byte(marker)); i >= 0 {
+			return []uint64{uint64(i)}, true
+		}
+	}
+	return nil, false
+}
+
+// entropy is the Shannon entropy of data in bits per byte, from 0 for a
+// single repeated byte to 8 for random data.
+func entropy(data []byte) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	n := float64(len(data))
+	var h float64
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
@@ -0,0 +1,20 @@
+package scanner
+
+// #cgo !yara_no_pkg_config,!yara_static  pkg-config: yara
+// #cgo !yara_no_pkg_config,yara_static   pkg-config: --static yara
+// #cgo yara_no_pkg_config                LDFLAGS:    -lyara -lm
+/*
+#include <yara.h>
+
+static const char *yara_header_version(void) { return YR_VERSION; }
+*/
+import "C"
+
+// yaraHeaderVersion is the version of the libyara headers the binary was
+// built against, found with the same build flags the go-yara binding uses.
+// Neither libyara nor go-yara report the version of the library loaded at
+// run time, so a shared libyara upgraded without a rebuild keeps the old
+// key; its compiled rules then fail to load and the cache is rebuilt.
+func yaraHeaderVersion() string {
+	return C.GoString(C.yara_header_version())
+}
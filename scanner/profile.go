@@ -0,0 +1,194 @@
+package scanner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anti-abuse-go/logger"
+	"anti-abuse-go/metrics"
+	"github.com/hillu/go-yara/v4"
+)
+
+// RuleCost is the time YARA spent on one rule.
+type RuleCost struct {
+	Namespace string        `json:"namespace"`
+	Rule      string        `json:"rule"`
+	Cost      time.Duration `json:"cost"`
+}
+
+// Profile sums the time YARA spends per rule across scans. YARA only
+// measures it when libyara is built with profiling enabled; otherwise every
+// cost stays zero.
+type Profile struct {
+	mu    sync.Mutex
+	costs map[[2]string]time.Duration
+}
+
+func NewProfile() *Profile {
+	return &Profile{costs: make(map[[2]string]time.Duration)}
+}
+
+func (p *Profile) add(infos []yara.RuleProfilingInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, info := range infos {
+		if info.Cost == 0 {
+			continue
+		}
+		key := [2]string{info.Namespace(), info.Identifier()}
+		p.costs[key] += time.Duration(info.Cost)
+	}
+}
+
+// Costs returns the rules with a recorded cost, most expensive first.
+func (p *Profile) Costs() []RuleCost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	costs := make([]RuleCost, 0, len(p.costs))
+	for key, cost := range p.costs {
+		costs = append(costs, RuleCost{Namespace: key[0], Rule: key[1], Cost: cost})
+	}
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i].Cost != costs[j].Cost {
+			return costs[i].Cost > costs[j].Cost
+		}
+		return costs[i].Rule < costs[j].Rule
+	})
+	return costs
+}
+
+// NamespaceCost is the time YARA spent on the rules of one namespace.
+type NamespaceCost struct {
+	Namespace string        `json:"namespace"`
+	Cost      time.Duration `json:"cost"`
+}
+
+// Namespaces sums the recorded costs per namespace, most expensive first.
+func (p *Profile) Namespaces() []NamespaceCost {
+	p.mu.Lock()
+	sums := make(map[string]time.Duration)
+	for key, cost := range p.costs {
+		sums[key[0]] += cost
+	}
+	p.mu.Unlock()
+
+	costs := make([]NamespaceCost, 0, len(sums))
+	for namespace, cost := range sums {
+		costs = append(costs, NamespaceCost{Namespace: namespace, Cost: cost})
+	}
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i].Cost != costs[j].Cost {
+			return costs[i].Cost > costs[j].Cost
+		}
+		return costs[i].Namespace < costs[j].Namespace
+	})
+	return costs
+}
+
+func (p *Profile) reset() {
+	p.mu.Lock()
+	p.costs = make(map[[2]string]time.Duration)
+	p.mu.Unlock()
+}
+
+// SlowRule is a rule that used more than the per-scan budget.
+type SlowRule struct {
+	Namespace string        `json:"namespace"`
+	Rule      string        `json:"rule"`
+	Exceeded  int           `json:"exceeded"` // Scans over budget since the rules were loaded
+	Max       time.Duration `json:"max"`
+	Disabled  bool          `json:"disabled"`
+}
+
+// ProfileReport is the profiling state of a scanner.
+type ProfileReport struct {
+	Enabled    bool            `json:"enabled"`
+	Budget     time.Duration   `json:"budget"`
+	Rules      []RuleCost      `json:"rules"`
+	Namespaces []NamespaceCost `json:"namespaces"`
+	OverBudget []SlowRule      `json:"over_budget"`
+}
+
+// observe records the profiling info of one scan and enforces the budget.
+// Disabled rules stay off until the rules are reloaded.
+func (s *Scanner) observe(infos []yara.RuleProfilingInfo) {
+	s.profile.add(infos)
+	if s.budget <= 0 {
+		return
+	}
+	for i := range infos {
+		cost := time.Duration(infos[i].Cost)
+		if cost <= s.budget {
+			continue
+		}
+		key := [2]string{infos[i].Namespace(), infos[i].Identifier()}
+
+		s.slowMu.Lock()
+		slow := s.slow[key]
+		first := slow == nil
+		if first {
+			slow = &SlowRule{Namespace: key[0], Rule: key[1]}
+			s.slow[key] = slow
+		}
+		slow.Exceeded++
+		if cost > slow.Max {
+			slow.Max = cost
+		}
+		disable := s.disableSlow && !slow.Disabled
+		slow.Disabled = slow.Disabled || disable
+		s.slowMu.Unlock()
+
+		metrics.RuleBudgetExceeded.Inc(key[1])
+		if disable {
+			infos[i].Rule.Disable()
+			logger.Log.Warnf("Disabled YARA rule %s:%s until the next rules reload: %s in one scan, over the %s budget", key[0], key[1], cost, s.budget)
+		} else if first {
+			logger.Log.Warnf("YARA rule %s:%s took %s in one scan, over the %s budget", key[0], key[1], cost, s.budget)
+		}
+	}
+}
+
+// SlowRules reports the n most expensive rules, the cost per namespace and
+// the rules that went over the budget.
+func (s *Scanner) SlowRules(n int) ProfileReport {
+	report := ProfileReport{
+		Enabled:    s.profile != nil,
+		Budget:     s.budget,
+		Rules:      make([]RuleCost, 0),
+		Namespaces: make([]NamespaceCost, 0),
+		OverBudget: make([]SlowRule, 0),
+	}
+	if s.profile == nil {
+		return report
+	}
+	report.Rules = s.profile.Costs()
+	if n > 0 && len(report.Rules) > n {
+		report.Rules = report.Rules[:n]
+	}
+	report.Namespaces = s.profile.Namespaces()
+
+	s.slowMu.Lock()
+	for _, slow := range s.slow {
+		report.OverBudget = append(report.OverBudget, *slow)
+	}
+	s.slowMu.Unlock()
+	sort.Slice(report.OverBudget, func(i, j int) bool { return report.OverBudget[i].Max > report.OverBudget[j].Max })
+	return report
+}
+
+// slowest names the most expensive rules of one scan for log messages.
+func slowest(infos []yara.RuleProfilingInfo, n int) string {
+	sorted := append([]yara.RuleProfilingInfo(nil), infos...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Cost > sorted[j].Cost })
+	var names []string
+	for _, info := range sorted {
+		if len(names) == n || info.Cost == 0 {
+			break
+		}
+		names = append(names, fmt.Sprintf("%s:%s (%s)", info.Namespace(), info.Identifier(), time.Duration(info.Cost)))
+	}
+	return strings.Join(names, ", ")
+}
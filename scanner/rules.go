@@ -0,0 +1,375 @@
+package scanner
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"anti-abuse-go/logger"
+	"github.com/hillu/go-yara/v4"
+)
+
+// CompileMessage is a compiler error or warning.
+type CompileMessage struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+func (m CompileMessage) String() string {
+	location := m.File
+	if m.Line > 0 {
+		location = fmt.Sprintf("%s:%d", m.File, m.Line)
+	}
+	if m.Rule != "" {
+		return fmt.Sprintf("%s: rule %s: %s", location, m.Rule, m.Message)
+	}
+	return fmt.Sprintf("%s: %s", location, m.Message)
+}
+
+// CompileReport describes the last rule load: which files were used and
+// every error and warning the compiler raised. Files that fail are left out
+// of the loaded rules.
+type CompileReport struct {
+	Path     string           `json:"path"`
+	Time     time.Time        `json:"time"`
+	Cached   bool             `json:"cached"` // Loaded from the compiled rule cache
+	Files    int              `json:"files"`  // Rule files loaded
+	Failed   int              `json:"failed"` // Rule files left out because of errors
+	Rules    int              `json:"rules"`
+	Errors   []CompileMessage `json:"errors"`
+	Warnings []CompileMessage `json:"warnings"`
+}
+
+func newCompileReport(path string) *CompileReport {
+	return &CompileReport{
+		Path:     path,
+		Time:     time.Now(),
+		Errors:   make([]CompileMessage, 0),
+		Warnings: make([]CompileMessage, 0),
+	}
+}
+
+// Err summarizes the errors of the report, nil when there are none.
+func (r *CompileReport) Err() error {
+	switch len(r.Errors) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s", r.Errors[0])
+	default:
+		return fmt.Errorf("%s (and %d more errors)", r.Errors[0], len(r.Errors)-1)
+	}
+}
+
+func (r *CompileReport) log() {
+	for _, m := range r.Errors {
+		logger.Log.Warnf("YARA rule error: %s", m)
+	}
+	for _, m := range r.Warnings {
+		logger.Log.Debugf("YARA rule warning: %s", m)
+	}
+	if len(r.Warnings) > 0 {
+		logger.Log.Infof("YARA rules compiled with %d warnings, see \"sentinel ctl rules-report\"", len(r.Warnings))
+	}
+}
+
+// ruleSource is a rule file and the namespace its rules are compiled into.
+type ruleSource struct {
+	Path      string
+	Namespace string
+}
+
+// ruleSet is the rule files found under a signature path.
+type ruleSet struct {
+	root     string
+	sources  []ruleSource
+	compiled []string // Precompiled .yarc files
+	includes []string // Files pulled in by include statements, not compiled on their own
+}
+
+// collectRules walks a signature path. Files in a subdirectory share a
+// namespace named after the directory, so a vendor set can reference its
+// own rules while rule names only need to be unique within the set. Files
+// at the top level each get their own namespace. Hidden directories are
+// skipped.
+func collectRules(signaturePath string) (*ruleSet, []CompileMessage, error) {
+	root, err := filepath.Abs(signaturePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !info.IsDir() {
+		set := &ruleSet{root: filepath.Dir(root)}
+		switch {
+		case isCompiledRuleFile(root):
+			set.compiled = append(set.compiled, root)
+		case isRuleFile(root):
+			set.sources = append(set.sources, ruleSource{Path: root, Namespace: filepath.Base(root)})
+		default:
+			return nil, nil, fmt.Errorf("file must have .yar, .yara or .yarc extension: %s", signaturePath)
+		}
+		set.includes = findIncludes(set.sources, set.root)
+		return set, nil, nil
+	}
+
+	set := &ruleSet{root: root}
+	var problems []CompileMessage
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			problems = append(problems, CompileMessage{File: set.rel(path), Message: err.Error()})
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch {
+		case isCompiledRuleFile(d.Name()):
+			set.compiled = append(set.compiled, path)
+		case isRuleFile(d.Name()):
+			namespace := set.rel(filepath.Dir(path))
+			if namespace == "." {
+				namespace = d.Name()
+			}
+			set.sources = append(set.sources, ruleSource{Path: path, Namespace: namespace})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Files included by another rule file are compiled through that file
+	set.includes = findIncludes(set.sources, root)
+	included := make(map[string]bool, len(set.includes))
+	for _, path := range set.includes {
+		included[path] = true
+	}
+	sources := set.sources[:0]
+	for _, src := range set.sources {
+		if !included[src.Path] {
+			sources = append(sources, src)
+		}
+	}
+	set.sources = sources
+	return set, problems, nil
+}
+
+// rel shortens a path below the signature root for reports.
+func (set *ruleSet) rel(path string) string {
+	if rel, err := filepath.Rel(set.root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+var includePattern = regexp.MustCompile(`(?m)^\s*include\s+"([^"]+)"`)
+
+// findIncludes follows the include statements of the sources, returning
+// every file they pull in from below root.
+func findIncludes(sources []ruleSource, root string) []string {
+	var includes []string
+	seen := make(map[string]bool)
+	queue := make([]string, 0, len(sources))
+	for _, src := range sources {
+		queue = append(queue, src.Path)
+	}
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, m := range includePattern.FindAllSubmatch(data, -1) {
+			target, ok := resolveInclude(root, filepath.Dir(path), string(m[1]))
+			if !ok || seen[target] {
+				continue
+			}
+			seen[target] = true
+			includes = append(includes, target)
+			queue = append(queue, target)
+		}
+	}
+	return includes
+}
+
+// resolveInclude resolves an include name relative to the including file.
+// Includes may not leave the signature root.
+func resolveInclude(root, dir, name string) (string, bool) {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, name)
+	}
+	path = filepath.Clean(path)
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
+
+// includeResolver serves include statements to the compiler. YARA reports
+// nested includes by the name they were included as, so resolved names are
+// remembered to find the directory of the including file.
+type includeResolver struct {
+	root     string
+	resolved map[string]string
+}
+
+func (r *includeResolver) include(name, filename, namespace string) []byte {
+	dir := r.root
+	if path, ok := r.resolved[filename]; ok {
+		dir = filepath.Dir(path)
+	} else if filepath.IsAbs(filename) {
+		dir = filepath.Dir(filename)
+	}
+	path, ok := resolveInclude(r.root, dir, name)
+	if !ok {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	r.resolved[name] = path
+	return data
+}
+
+// compileSources compiles the sources of set into one rule set. A compiler
+// cannot be used after an error, so a file that fails is recorded in the
+// report and compilation restarts without it. It returns nil rules when no
+// file compiles.
+func compileSources(set *ruleSet, report *CompileReport) (*yara.Rules, error) {
+	sources := set.sources
+	for len(sources) > 0 {
+		compiler, err := yara.NewCompiler()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create YARA compiler: %w", err)
+		}
+		if err := defineExternals(compiler); err != nil {
+			compiler.Destroy()
+			return nil, fmt.Errorf("failed to declare external variables: %w", err)
+		}
+		resolver := &includeResolver{root: set.root, resolved: make(map[string]string)}
+		compiler.SetIncludeCallback(resolver.include)
+
+		failed := -1
+		for i, src := range sources {
+			if err := addSource(compiler, src); err != nil {
+				report.Errors = append(report.Errors, set.messages(compiler.Errors, src.Path, err)...)
+				failed = i
+				break
+			}
+			logger.Log.Debugf("Added YARA rules from %s", src.Path)
+		}
+		if failed >= 0 {
+			compiler.Destroy()
+			sources = append(sources[:failed:failed], sources[failed+1:]...)
+			report.Failed++
+			continue
+		}
+
+		report.Warnings = append(report.Warnings, set.messages(compiler.Warnings, "", nil)...)
+		rules, err := compiler.GetRules()
+		compiler.Destroy()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get compiled rules: %w", err)
+		}
+		report.Files += len(sources)
+		return rules, nil
+	}
+	return nil, nil
+}
+
+func addSource(compiler *yara.Compiler, src ruleSource) error {
+	file, err := os.Open(src.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return compiler.AddFile(file, src.Namespace)
+}
+
+// messages converts compiler messages, falling back to err when the
+// compiler recorded none.
+func (set *ruleSet) messages(msgs []yara.CompilerMessage, path string, err error) []CompileMessage {
+	out := make([]CompileMessage, 0, len(msgs))
+	for _, m := range msgs {
+		file := m.Filename
+		if file == "" {
+			file = path
+		}
+		out = append(out, CompileMessage{File: set.rel(file), Line: m.Line, Rule: m.Rule, Message: m.Text})
+	}
+	if len(out) == 0 && err != nil {
+		out = append(out, CompileMessage{File: set.rel(path), Message: err.Error()})
+	}
+	return out
+}
+
+// loadCompiled loads the precompiled rule files of set, recording failures
+// in the report.
+func loadCompiled(set *ruleSet, report *CompileReport) []*yara.Rules {
+	var rulesList []*yara.Rules
+	for _, path := range set.compiled {
+		rules, err := yara.LoadRules(path)
+		if err != nil {
+			report.Errors = append(report.Errors, CompileMessage{File: set.rel(path), Message: err.Error()})
+			report.Failed++
+			continue
+		}
+		logger.Log.Debugf("Loaded compiled YARA rules from %s", path)
+		rulesList = append(rulesList, rules)
+		report.Files++
+	}
+	return rulesList
+}
+
+// CheckRules compiles the rule files below dir without loading them into
+// any scanner, and loads any precompiled .yarc files. Unlike loading, any
+// file that fails is an error. It returns the number of rules.
+func CheckRules(dir string) (int, error) {
+	set, problems, err := collectRules(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(set.sources) == 0 && len(set.compiled) == 0 {
+		return 0, fmt.Errorf("no rule files in %s", dir)
+	}
+
+	report := newCompileReport(dir)
+	report.Errors = append(report.Errors, problems...)
+	rulesList := loadCompiled(set, report)
+	rules, err := compileSources(set, report)
+	if err != nil {
+		return 0, err
+	}
+	if rules != nil {
+		rulesList = append(rulesList, rules)
+	}
+	if err := report.Err(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, rules := range rulesList {
+		count += len(rules.GetRules())
+		rules.Destroy()
+	}
+	return count, nil
+}
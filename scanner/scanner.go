@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"archive/zip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,27 +12,88 @@ import (
 	"time"
 
 	"anti-abuse-go/logger"
+	"anti-abuse-go/metrics"
 	"github.com/hillu/go-yara/v4"
 	"github.com/nwaples/rardecode"
 )
 
 // Match represents a YARA match
 type Match struct {
-	Rule string
-	Tags string
+	Rule      string
+	Namespace string // Namespace of the rule, "heuristic" for heuristic matches
+	Tags      string
+	Offsets   []uint64 // Offsets of the matched strings, capped at maxMatchOffsets
+	Member    string   // Archive entry the match was found in, empty for the file itself
+	Severity  string   // low, medium, high or critical from the rule's severity meta or tag
 }
 
+const maxMatchOffsets = 16
+
 type MatchRules []Match
 
 type Scanner struct {
-	rules []*yara.Rules
-	mu    sync.RWMutex
+	rules    []ruleGroup
+	report   *CompileReport
+	cacheDir string // Compiled rule cache, empty when disabled
+	strict   bool
+	mu       sync.RWMutex
+
+	profile     *Profile // nil unless profiling is enabled
+	budget      time.Duration
+	disableSlow bool
+	slow        map[[2]string]*SlowRule
+	slowMu      sync.Mutex
+
+	profiles   []*ScanProfile // Guarded by mu
+	heuristics Heuristics     // Guarded by mu
+}
+
+// Options configures how a Scanner loads its rules.
+type Options struct {
+	// CacheDir holds compiled rules, default /var/lib/sentinel/rule-cache;
+	// "none" disables the cache.
+	CacheDir string
+	// Strict fails loading when any rule file has errors instead of
+	// leaving the file out.
+	Strict bool
+	// Profile sums the time spent per rule across scans. YARA only
+	// measures it when libyara is built with --enable-profiling.
+	Profile bool
+	// RuleBudget is the time one rule may use in a single scan, zero for
+	// no limit. It needs Profile.
+	RuleBudget time.Duration
+	// DisableSlowRules disables rules over the budget until the next
+	// reload instead of only warning.
+	DisableSlowRules bool
+	// Profiles set timeouts, limits and rule namespaces per path; see
+	// SetProfiles.
+	Profiles []ScanProfile
+	// Heuristics flag packed and high-entropy executables next to YARA.
+	Heuristics Heuristics
 }
 
-func NewScanner(signaturePath string) (*Scanner, error) {
+func NewScanner(signaturePath string, opts Options) (*Scanner, error) {
+	cacheDir := opts.CacheDir
+	switch cacheDir {
+	case "":
+		cacheDir = defaultCacheDir
+	case "none":
+		cacheDir = ""
+	}
 	scanner := &Scanner{
-		rules: make([]*yara.Rules, 0),
+		rules:    make([]ruleGroup, 0),
+		report:   newCompileReport(signaturePath),
+		cacheDir: cacheDir,
+		strict:   opts.Strict,
 	}
+	if opts.Profile {
+		scanner.profile = NewProfile()
+		scanner.budget = opts.RuleBudget
+		scanner.disableSlow = opts.DisableSlowRules
+		scanner.slow = make(map[[2]string]*SlowRule)
+	}
+	scanner.SetProfiles(opts.Profiles)
+	scanner.SetHeuristics(opts.Heuristics)
 	if err := scanner.loadRules(signaturePath); err != nil {
 		return nil, err
 	}
@@ -40,141 +102,275 @@ func NewScanner(signaturePath string) (*Scanner, error) {
 
 func (s *Scanner) loadRules(signaturePath string) error {
 	logger.Log.Infof("Loading YARA rules from %s", signaturePath)
+	report := newCompileReport(signaturePath)
 
 	// Check if path is a file or directory
-	fileInfo, err := os.Stat(signaturePath)
-	if err != nil {
+	if _, err := os.Stat(signaturePath); err != nil {
 		logger.Log.Warnf("Signature path not found: %s - no YARA rules will be applied", signaturePath)
 		// Return empty scanner instead of error - allow first-time startup
-		s.rules = make([]*yara.Rules, 0)
+		s.setRules(nil, report)
 		return nil
 	}
 
-	var filesToCompile []string
-
-	if fileInfo.IsDir() {
-		// Load all .yar and .yara files from directory
-		files, err := os.ReadDir(signaturePath)
-		if err != nil {
+	set, problems, err := collectRules(signaturePath)
+	if err != nil {
+		if os.IsPermission(err) || os.IsNotExist(err) {
 			logger.Log.Warnf("Failed to read signature directory %s: %v - no YARA rules will be applied", signaturePath, err)
-			s.rules = make([]*yara.Rules, 0)
+			s.setRules(nil, report)
 			return nil
 		}
+		return err
+	}
+	report.Errors = append(report.Errors, problems...)
 
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-
-			filename := file.Name()
-			if !(strings.HasSuffix(filename, ".yar") || strings.HasSuffix(filename, ".yara")) {
-				continue
-			}
+	if len(set.sources) == 0 && len(set.compiled) == 0 {
+		logger.Log.Warnf("No YARA rules found in directory %s - scanner will not detect anything", signaturePath)
+		s.setRules(nil, report)
+		return nil
+	}
 
-			rulePath := filepath.Join(signaturePath, filename)
-			filesToCompile = append(filesToCompile, rulePath)
+	// Namespaces are compiled in groups so a scan profile only runs the
+	// rules it allows
+	var rulesList []ruleGroup
+	var keys []string
+	groups := s.groupSources(set)
+	cached := len(groups) > 0
+	for _, group := range groups {
+		rules, key, hit, err := s.compile(group, report)
+		if err != nil {
+			return err
 		}
-
-		if len(filesToCompile) == 0 {
-			logger.Log.Warnf("No YARA rules found in directory %s - scanner will not detect anything", signaturePath)
-			s.rules = make([]*yara.Rules, 0)
-			return nil
+		cached = cached && hit
+		if key != "" {
+			keys = append(keys, key)
 		}
-	} else {
-		// Single file
-		if !(strings.HasSuffix(signaturePath, ".yar") || strings.HasSuffix(signaturePath, ".yara")) {
-			return fmt.Errorf("file must have .yar or .yara extension: %s", signaturePath)
+		if rules != nil {
+			rulesList = append(rulesList, newRuleGroup(rules, group))
 		}
-		filesToCompile = append(filesToCompile, signaturePath)
 	}
-
-	// Compile all rules together
-	compiler, err := yara.NewCompiler()
-	if err != nil {
-		return fmt.Errorf("failed to create YARA compiler: %w", err)
+	report.Cached = cached
+	if s.cacheDir != "" && len(keys) == len(groups) {
+		s.pruneCache(keys)
+	}
+	for _, rules := range loadCompiled(set, report) {
+		rulesList = append(rulesList, newRuleGroup(rules, nil))
+	}
+	for _, group := range rulesList {
+		report.Rules += len(group.rules.GetRules())
 	}
 
-	var compiledCount int
-	for _, rulePath := range filesToCompile {
-		file, err := os.Open(rulePath)
-		if err != nil {
-			logger.Log.Warnf("Failed to open YARA file %s: %v", rulePath, err)
-			continue
-		}
-
-		err = compiler.AddFile(file, rulePath)
-		file.Close()
-		if err != nil {
-			logger.Log.Warnf("Failed to compile YARA rules from %s: %v", rulePath, err)
-			continue
+	report.log()
+	if s.strict {
+		if err := report.Err(); err != nil {
+			// Keep scanning with the rules already loaded
+			s.mu.Lock()
+			s.report = report
+			s.mu.Unlock()
+			return fmt.Errorf("strict rule loading: %w", err)
 		}
-
-		logger.Log.Debugf("Added YARA rules from %s", rulePath)
-		compiledCount++
 	}
 
-	if compiledCount == 0 {
-		logger.Log.Warnf("Failed to compile any YARA rules from %d files - scanner will not detect anything", len(filesToCompile))
-		s.rules = make([]*yara.Rules, 0)
+	if len(rulesList) == 0 {
+		logger.Log.Warnf("Failed to load any YARA rules from %d files - scanner will not detect anything", report.Failed)
+		s.setRules(nil, report)
 		return nil
 	}
 
-	rules, err := compiler.GetRules()
-	if err != nil {
-		return fmt.Errorf("failed to get compiled rules: %w", err)
-	}
+	s.setRules(rulesList, report)
 
+	logger.Log.Infof("YARA rules loaded successfully (%d files, %d rules, %d failed)", report.Files, report.Rules, report.Failed)
+
+	return nil
+}
+
+// setRules replaces rather than appends so a reload does not scan with
+// stale rules.
+func (s *Scanner) setRules(rulesList []ruleGroup, report *CompileReport) {
+	if rulesList == nil {
+		rulesList = make([]ruleGroup, 0)
+	}
 	s.mu.Lock()
-	s.rules = append(s.rules, rules)
+	s.rules = rulesList
+	s.report = report
 	s.mu.Unlock()
 
-	logger.Log.Infof("YARA rules loaded successfully (%d files)", len(filesToCompile))
+	// Costs and disabled rules belong to the previous rules
+	if s.profile != nil {
+		s.profile.reset()
+		s.slowMu.Lock()
+		s.slow = make(map[[2]string]*SlowRule)
+		s.slowMu.Unlock()
+	}
+}
 
-	return nil
+// compile compiles the rule sources of set, reusing the cached result
+// when none of the files changed. It returns the cache key, empty without
+// a cache, and whether the rules came from the cache.
+func (s *Scanner) compile(set *ruleSet, report *CompileReport) (*yara.Rules, string, bool, error) {
+	var key string
+	if s.cacheDir != "" {
+		var err error
+		if key, err = cacheKey(set); err != nil {
+			logger.Log.WithError(err).Warn("Failed to hash YARA rule files - not using the rule cache")
+			key = ""
+		} else if rules, cached := s.loadCached(key); rules != nil {
+			report.Files += cached.Files
+			report.Failed += cached.Failed
+			report.Errors = append(report.Errors, cached.Errors...)
+			report.Warnings = append(report.Warnings, cached.Warnings...)
+			logger.Log.Infof("Loaded compiled YARA rules from cache (%d files)", cached.Files)
+			return rules, key, true, nil
+		}
+	}
+
+	// Cache only what this compilation reported, not the other files
+	compiled := newCompileReport(report.Path)
+	rules, err := compileSources(set, compiled)
+	if err != nil {
+		return nil, "", false, err
+	}
+	report.Files += compiled.Files
+	report.Failed += compiled.Failed
+	report.Errors = append(report.Errors, compiled.Errors...)
+	report.Warnings = append(report.Warnings, compiled.Warnings...)
+
+	if rules != nil && key != "" {
+		s.saveCached(key, rules, compiled)
+	}
+	return rules, key, false, nil
 }
 
+// Scan scans data found at filePath.
 func (s *Scanner) Scan(data []byte, filePath string) (MatchRules, error) {
+	return s.ScanTarget(data, Target{Path: filePath, OwnerUID: -1})
+}
+
+// ScanTarget scans data, exposing target to the rules as external variables.
+func (s *Scanner) ScanTarget(data []byte, target Target) (MatchRules, error) {
 	s.mu.RLock()
 	rulesList := s.rules
+	heuristics := s.heuristics
 	s.mu.RUnlock()
 
-	if len(rulesList) == 0 {
+	// Without YARA rules the heuristics still run on their own
+	if len(rulesList) == 0 && !heuristics.Enabled {
 		return nil, fmt.Errorf("scanner not initialized - no rules loaded")
 	}
+	if target.scan == nil {
+		target.scan = s.profileFor(target.Path)
+	}
 
-	if isArchiveFile(filePath) {
-		if isJarFile(filePath) {
-			return s.scanJar(data)
-		} else if isRarFile(filePath) {
-			return s.scanRar(data)
+	// Archives nested deeper than the profile allows are scanned as is
+	if isArchiveFile(target.Path) && target.depth < target.scan.ArchiveDepth {
+		if isJarFile(target.Path) {
+			return s.scanJar(data, target)
+		} else if isRarFile(target.Path) {
+			return s.scanRar(data, target)
 		}
 	}
 
 	// Collect matches from all rule files
 	var allMatches MatchRules
 
-	for _, rules := range rulesList {
-		var matches yara.MatchRules
-
+	for _, group := range rulesList {
+		if !target.scan.allowsAny(group.namespaces) {
+			continue
+		}
 		// Scan the data with timeout
-		err := rules.ScanMem(data, 0, 30*time.Second, &matches)
+		matches, infos, err := scanRules(group.rules, data, target, s.profile != nil || target.Profile != nil)
+		if target.Profile != nil {
+			target.Profile.add(infos)
+		}
+		if s.profile != nil {
+			s.observe(infos)
+		}
 		if err != nil {
-			logger.Log.Warnf("Scan failed with ruleset: %v", err)
+			var yerr yara.Error
+			if errors.As(err, &yerr) && yerr.Code == yara.ERROR_SCAN_TIMEOUT {
+				metrics.YaraTimeouts.Inc()
+				if names := slowest(infos, 3); names != "" {
+					err = fmt.Errorf("%w, slowest rules: %s", err, names)
+				}
+			}
+			logger.Log.Warnf("Scan of %s failed with ruleset: %v", target.Path, err)
 			continue
 		}
 
 		// Convert from yara.MatchRules to our Match type
 		for _, matchRule := range matches {
+			if !target.scan.allows(matchRule.Namespace) {
+				continue
+			}
 			allMatches = append(allMatches, Match{
-				Rule: matchRule.Rule,
-				Tags: strings.Join(matchRule.Tags, ","),
+				Rule:      matchRule.Rule,
+				Namespace: matchRule.Namespace,
+				Tags:      strings.Join(matchRule.Tags, ","),
+				Offsets:   matchOffsets(matchRule.Strings),
+				Severity:  ruleSeverity(matchRule),
 			})
 		}
 	}
 
+	if heuristics.Enabled && target.scan.allows(heuristicNamespace) {
+		allMatches = append(allMatches, heuristics.analyze(data, target.Path)...)
+	}
+
 	return allMatches, nil
 }
 
+func matchOffsets(strs []yara.MatchString) []uint64 {
+	var offsets []uint64
+	seen := make(map[uint64]bool)
+	for _, str := range strs {
+		if seen[str.Offset] {
+			continue
+		}
+		seen[str.Offset] = true
+		offsets = append(offsets, str.Offset)
+		if len(offsets) >= maxMatchOffsets {
+			break
+		}
+	}
+	return offsets
+}
+
+var severityLevels = map[string]bool{"low": true, "medium": true, "high": true, "critical": true}
+
+// ruleSeverity reads the severity meta of a rule, falling back to a tag
+// named after a severity level.
+func ruleSeverity(rule yara.MatchRule) string {
+	return severityOf(rule.Metas, rule.Tags)
+}
+
+func severityOf(metas []yara.Meta, tags []string) string {
+	for _, meta := range metas {
+		if strings.EqualFold(meta.Identifier, "severity") {
+			if value, ok := meta.Value.(string); ok && severityLevels[strings.ToLower(value)] {
+				return strings.ToLower(value)
+			}
+		}
+	}
+	for _, tag := range tags {
+		if severityLevels[strings.ToLower(tag)] {
+			return strings.ToLower(tag)
+		}
+	}
+	return ""
+}
+
+// inMember tags matches found inside an archive entry with the entry name,
+// prefixing it for entries of nested archives.
+func inMember(matches MatchRules, member string) MatchRules {
+	for i := range matches {
+		if matches[i].Member == "" {
+			matches[i].Member = member
+		} else {
+			matches[i].Member = member + "/" + matches[i].Member
+		}
+	}
+	return matches
+}
+
 func isArchiveFile(path string) bool {
 	ext := filepath.Ext(path)
 	return ext == ".jar" || ext == ".zip" || ext == ".rar"
@@ -190,7 +386,7 @@ func isRarFile(path string) bool {
 	return ext == ".rar"
 }
 
-func (s *Scanner) scanJar(data []byte) (MatchRules, error) {
+func (s *Scanner) scanJar(data []byte, target Target) (MatchRules, error) {
 	reader, err := zip.NewReader(strings.NewReader(string(data)), int64(len(data)))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open JAR: %w", err)
@@ -201,8 +397,8 @@ func (s *Scanner) scanJar(data []byte) (MatchRules, error) {
 		if file.FileInfo().IsDir() {
 			continue
 		}
-		if file.UncompressedSize64 > 10*1024*1024 { // 10MB limit per file in JAR
-			logger.Log.Debugf("Skipping %s in JAR (size > 10MB)", file.Name)
+		if file.UncompressedSize64 > uint64(target.scan.MaxEntrySize) {
+			logger.Log.Debugf("Skipping %s in JAR (size > %d bytes)", file.Name, target.scan.MaxEntrySize)
 			continue
 		}
 
@@ -220,19 +416,19 @@ func (s *Scanner) scanJar(data []byte) (MatchRules, error) {
 		}
 
 		// Scan the extracted file content
-		matches, err := s.Scan(content, file.Name)
+		matches, err := s.ScanTarget(content, target.inArchive(file.Name))
 		if err != nil {
 			logger.Log.Warnf("Error scanning %s in JAR: %v", file.Name, err)
 			continue
 		}
 
-		allMatches = append(allMatches, matches...)
+		allMatches = append(allMatches, inMember(matches, file.Name)...)
 	}
 
 	return allMatches, nil
 }
 
-func (s *Scanner) scanRar(data []byte) (MatchRules, error) {
+func (s *Scanner) scanRar(data []byte, target Target) (MatchRules, error) {
 	reader, err := rardecode.NewReader(strings.NewReader(string(data)), "")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open RAR: %w", err)
@@ -253,28 +449,91 @@ func (s *Scanner) scanRar(data []byte) (MatchRules, error) {
 			continue
 		}
 
-		// Note: rardecode.FileHeader doesn't have a Size field, so no size limit check for RAR
-		// Read the entire content (similar to Python implementation)
-
-		content, err := io.ReadAll(reader)
+		// The unpacked size in the header can't be trusted, so stop reading
+		// one byte past the limit
+		content, err := io.ReadAll(io.LimitReader(reader, target.scan.MaxEntrySize+1))
 		if err != nil {
 			logger.Log.Warnf("Failed to read %s in RAR: %v", header.Name, err)
 			continue
 		}
+		if int64(len(content)) > target.scan.MaxEntrySize {
+			logger.Log.Debugf("Skipping %s in RAR (size > %d bytes)", header.Name, target.scan.MaxEntrySize)
+			continue
+		}
 
 		// Scan the extracted file content
-		matches, err := s.Scan(content, header.Name)
+		matches, err := s.ScanTarget(content, target.inArchive(header.Name))
 		if err != nil {
 			logger.Log.Warnf("Error scanning %s in RAR: %v", header.Name, err)
 			continue
 		}
 
-		allMatches = append(allMatches, matches...)
+		allMatches = append(allMatches, inMember(matches, header.Name)...)
 	}
 
 	return allMatches, nil
 }
 
+func isRuleFile(name string) bool {
+	return strings.HasSuffix(name, ".yar") || strings.HasSuffix(name, ".yara")
+}
+
+func isCompiledRuleFile(name string) bool {
+	return strings.HasSuffix(name, compiledExt)
+}
+
 func (s *Scanner) ReloadRules(signaturePath string) error {
 	return s.loadRules(signaturePath)
 }
+
+// Report returns the compile report of the last rule load.
+func (s *Scanner) Report() *CompileReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.report
+}
+
+// RuleCount returns the number of loaded YARA rules.
+func (s *Scanner) RuleCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, group := range s.rules {
+		count += len(group.rules.GetRules())
+	}
+	return count
+}
+
+// RuleInfo describes a loaded rule.
+type RuleInfo struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Tags      []string          `json:"tags,omitempty"`
+	Severity  string            `json:"severity,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+}
+
+// Rules lists the loaded rules.
+func (s *Scanner) Rules() []RuleInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]RuleInfo, 0)
+	for _, group := range s.rules {
+		for _, rule := range group.rules.GetRules() {
+			info := RuleInfo{
+				Namespace: rule.Namespace(),
+				Name:      rule.Identifier(),
+				Tags:      rule.Tags(),
+				Severity:  severityOf(rule.Metas(), rule.Tags()),
+			}
+			for _, meta := range rule.Metas() {
+				if info.Meta == nil {
+					info.Meta = make(map[string]string)
+				}
+				info.Meta[meta.Identifier] = fmt.Sprint(meta.Value)
+			}
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
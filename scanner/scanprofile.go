@@ -0,0 +1,215 @@
+package scanner
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hillu/go-yara/v4"
+)
+
+// Built-in limits for scan profiles that leave a setting unset.
+const (
+	defaultScanTimeout  = 30 * time.Second
+	defaultMaxFileSize  = 100 * 1024 * 1024
+	defaultMaxEntrySize = 10 * 1024 * 1024
+	defaultArchiveDepth = 5
+)
+
+// ScanProfile sets how files under some paths are scanned, e.g. a short
+// timeout and a credential ruleset for /root/.ssh.
+type ScanProfile struct {
+	Name string
+	// Paths are watch roots or glob patterns. A path matches a file below
+	// it; a pattern without a slash matches the file name. A profile
+	// without paths matches every file.
+	Paths        []string
+	Timeout      time.Duration // YARA timeout per scan, default 30s
+	MaxFileSize  int64         // Larger files are not read, default 100MB
+	MaxEntrySize int64         // Larger archive entries are skipped, default 10MB
+	// ArchiveDepth is how many levels of nested archives are opened,
+	// default 5. Below zero archives are scanned as plain files.
+	ArchiveDepth int
+	// Namespaces limits the scan to rules in these namespaces, empty for
+	// all. Precompiled rules outside them still run but do not match.
+	Namespaces []string
+	FastMode   bool // Stop at the first match of each string
+	DisableAI  bool // Skip AI analysis of detections
+}
+
+// withDefaults fills the unset limits.
+func (p ScanProfile) withDefaults() ScanProfile {
+	if p.Timeout <= 0 {
+		p.Timeout = defaultScanTimeout
+	}
+	if p.MaxFileSize <= 0 {
+		p.MaxFileSize = defaultMaxFileSize
+	}
+	if p.MaxEntrySize <= 0 {
+		p.MaxEntrySize = defaultMaxEntrySize
+	}
+	if p.ArchiveDepth == 0 {
+		p.ArchiveDepth = defaultArchiveDepth
+	}
+	return p
+}
+
+// matches reports whether the profile applies to path.
+func (p *ScanProfile) matches(path string) bool {
+	return len(p.Paths) == 0 || matchPath(p.Paths, path)
+}
+
+// matchPath reports whether path is below one of the paths or glob
+// patterns. Patterns without a slash match the file name.
+func matchPath(patterns []string, path string) bool {
+	path = filepath.Clean(path)
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+				return true
+			}
+			continue
+		}
+		pattern = filepath.Clean(pattern)
+		for dir := path; ; dir = filepath.Dir(dir) {
+			if ok, _ := filepath.Match(pattern, dir); ok {
+				return true
+			}
+			if parent := filepath.Dir(dir); parent == dir {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// allows reports whether matches of a rule in namespace count.
+func (p *ScanProfile) allows(namespace string) bool {
+	if len(p.Namespaces) == 0 {
+		return true
+	}
+	for _, allowed := range p.Namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAny reports whether matches of a rule in any of namespaces count.
+// A nil set stands for rules whose namespaces are unknown.
+func (p *ScanProfile) allowsAny(namespaces map[string]bool) bool {
+	if len(p.Namespaces) == 0 || namespaces == nil {
+		return true
+	}
+	for _, allowed := range p.Namespaces {
+		if namespaces[allowed] {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultScanProfile = ScanProfile{Name: "default"}.withDefaults()
+
+// SetProfiles replaces the scan profiles. The first profile matching a
+// file applies; files matching none get the built-in defaults. It reports
+// whether the namespaces the profiles select changed, in which case the
+// rules must be reloaded to be grouped for the new profiles.
+func (s *Scanner) SetProfiles(profiles []ScanProfile) bool {
+	list := make([]*ScanProfile, 0, len(profiles))
+	for i := range profiles {
+		p := profiles[i].withDefaults()
+		list = append(list, &p)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := namespaceFilters(s.profiles) != namespaceFilters(list)
+	s.profiles = list
+	return changed
+}
+
+// namespaceFilters describes the namespace lists of profiles, the input of
+// the rule grouping.
+func namespaceFilters(profiles []*ScanProfile) string {
+	var filters []string
+	for _, p := range profiles {
+		if len(p.Namespaces) > 0 {
+			namespaces := append([]string(nil), p.Namespaces...)
+			sort.Strings(namespaces)
+			filters = append(filters, strings.Join(namespaces, ","))
+		}
+	}
+	return strings.Join(filters, ";")
+}
+
+// ruleGroup is compiled rules and the namespaces in them.
+type ruleGroup struct {
+	rules      *yara.Rules
+	namespaces map[string]bool // nil for precompiled rules
+}
+
+// newRuleGroup describes rules compiled from set; with a nil set the
+// namespaces are read from the rules.
+func newRuleGroup(rules *yara.Rules, set *ruleSet) ruleGroup {
+	group := ruleGroup{rules: rules}
+	if set != nil {
+		group.namespaces = make(map[string]bool)
+		for _, src := range set.sources {
+			group.namespaces[src.Namespace] = true
+		}
+	} else if list := rules.GetRules(); len(list) > 0 {
+		group.namespaces = make(map[string]bool)
+		for _, rule := range list {
+			group.namespaces[rule.Namespace()] = true
+		}
+	}
+	return group
+}
+
+// groupSources splits the sources of set by the scan profiles that allow
+// their namespace. Namespaces every profile treats alike share one group,
+// so without namespace filters all rules are compiled and scanned at once.
+func (s *Scanner) groupSources(set *ruleSet) []*ruleSet {
+	s.mu.RLock()
+	profiles := s.profiles
+	s.mu.RUnlock()
+
+	var groups []*ruleSet
+	index := make(map[string]*ruleSet)
+	for _, src := range set.sources {
+		var key strings.Builder
+		for _, p := range profiles {
+			if len(p.Namespaces) > 0 && p.allows(src.Namespace) {
+				key.WriteByte('1')
+			} else {
+				key.WriteByte('0')
+			}
+		}
+		group := index[key.String()]
+		if group == nil {
+			group = &ruleSet{root: set.root, includes: set.includes}
+			index[key.String()] = group
+			groups = append(groups, group)
+		}
+		group.sources = append(group.sources, src)
+	}
+	return groups
+}
+
+// ScanProfileFor returns the scan profile that applies to path.
+func (s *Scanner) ScanProfileFor(path string) ScanProfile {
+	return *s.profileFor(path)
+}
+
+func (s *Scanner) profileFor(path string) *ScanProfile {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, p := range s.profiles {
+		if p.matches(path) {
+			return p
+		}
+	}
+	return &defaultScanProfile
+}
@@ -0,0 +1,65 @@
+package sdnotify
+
+import (
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notify sends a state string such as "READY=1" to the service manager over
+// $NOTIFY_SOCKET. It does nothing when not started by systemd.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func Ready() error {
+	return Notify("READY=1")
+}
+
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+func Reloading() error {
+	return Notify("RELOADING=1")
+}
+
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+func Watchdog() error {
+	return Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout systemd expects heartbeats
+// within, or zero when the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	// Values that overflow a Duration are as good as no watchdog
+	if err != nil || usec <= 0 || usec > math.MaxInt64/int64(time.Microsecond) {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
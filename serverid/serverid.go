@@ -0,0 +1,23 @@
+package serverid
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var uuidRegex = regexp.MustCompile(`^[a-f0-9]{8}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{4}-[a-f0-9]{12}$`)
+
+// FromPath extracts the server UUID from a path like /var/lib/pterodactyl/volumes/uuid/...
+// It returns an empty string when the path does not live inside a server volume.
+func FromPath(path string) string {
+	parts := strings.Split(path, string(filepath.Separator))
+	for i, part := range parts {
+		if uuidRegex.MatchString(part) {
+			if i+1 < len(parts) {
+				return part
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"anti-abuse-go/logger"
+	"anti-abuse-go/scanner"
+)
+
+// ruleSample is a labelled sample for test-rules.
+type ruleSample struct {
+	File    string   `json:"file"`
+	Path    string   `json:"path,omitempty"`     // Path the rules see, default the file itself
+	Match   []string `json:"match,omitempty"`    // Rules that must match, as rule or namespace:rule
+	NoMatch []string `json:"no_match,omitempty"` // Rules that must not match, as rule or namespace:rule
+	Clean   bool     `json:"clean,omitempty"`    // No rule may match
+}
+
+// ruleResult counts the outcomes of one rule over the samples.
+type ruleResult struct {
+	Rule           string        `json:"rule"` // namespace:rule
+	TruePositives  int           `json:"true_positives"`
+	FalsePositives int           `json:"false_positives"`
+	TrueNegatives  int           `json:"true_negatives"`
+	FalseNegatives int           `json:"false_negatives"`
+	Time           time.Duration `json:"time_ns,omitempty"` // Only with a profiling libyara
+}
+
+// ruleFailure is a sample that did not behave as labelled.
+type ruleFailure struct {
+	File   string `json:"file"`
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// ruleTestReport is the result of test-rules.
+type ruleTestReport struct {
+	Samples  int           `json:"samples"`
+	Rules    []ruleResult  `json:"rules"`
+	Failures []ruleFailure `json:"failures"`
+	Duration time.Duration `json:"duration_ns"`
+	Profiled bool          `json:"profiled"`
+}
+
+// runTestRulesCommand compiles a rule path and checks it against labelled
+// samples, exiting non-zero when any sample is missed or wrongly matched.
+func runTestRulesCommand(args []string) {
+	fs := flag.NewFlagSet("test-rules", flag.ExitOnError)
+	samplesDir := fs.String("samples", "", "Sample directory with positive/<rule>/, negative/<rule>/ and clean/ subfolders; <rule> may be <namespace>:<rule>")
+	manifest := fs.String("manifest", "", "JSON list of samples ({\"file\", \"path\", \"match\", \"no_match\", \"clean\"}) instead of subfolders")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sentinel test-rules -samples <dir> | -manifest <file> [-json] <rules path>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*samplesDir == "") == (*manifest == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var samples []ruleSample
+	var err error
+	if *manifest != "" {
+		samples, err = loadSampleManifest(*manifest)
+	} else {
+		samples, err = loadSampleDir(*samplesDir)
+	}
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Failed to load samples")
+	}
+	if len(samples) == 0 {
+		logger.Log.Fatal("No samples found")
+	}
+
+	// A rule test compiles from scratch and treats any broken file as a failure
+	scan, err := scanner.NewScanner(fs.Arg(0), scanner.Options{CacheDir: "none", Strict: true})
+	if err != nil {
+		logger.Log.WithError(err).Fatal("Rules do not compile")
+	}
+	if scan.RuleCount() == 0 {
+		logger.Log.Fatalf("No rules loaded from %s", fs.Arg(0))
+	}
+
+	report := testRules(scan, samples)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			logger.Log.WithError(err).Fatal("Failed to write report")
+		}
+	} else {
+		printRuleTestReport(report)
+	}
+	if len(report.Failures) > 0 {
+		os.Exit(1)
+	}
+}
+
+// loadSampleDir labels samples by folder: files below positive/<rule>/ must
+// match the rule, below negative/<rule>/ must not, and below clean/ must
+// not match any rule. A folder named <namespace>:<rule> picks the rule of
+// that namespace.
+func loadSampleDir(dir string) ([]ruleSample, error) {
+	var samples []ruleSample
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		switch {
+		case parts[0] == "clean":
+			samples = append(samples, ruleSample{File: path, Clean: true})
+		case parts[0] == "positive" && len(parts) > 2:
+			samples = append(samples, ruleSample{File: path, Match: []string{parts[1]}})
+		case parts[0] == "negative" && len(parts) > 2:
+			samples = append(samples, ruleSample{File: path, NoMatch: []string{parts[1]}})
+		default:
+			logger.Log.Warnf("Ignoring unlabelled sample %s", path)
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// loadSampleManifest reads a JSON list of samples. Files are relative to
+// the manifest.
+func loadSampleManifest(path string) ([]ruleSample, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var samples []ruleSample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	for i := range samples {
+		if samples[i].File == "" {
+			return nil, fmt.Errorf("sample %d has no file", i+1)
+		}
+		if !filepath.IsAbs(samples[i].File) {
+			samples[i].File = filepath.Join(filepath.Dir(path), samples[i].File)
+		}
+	}
+	return samples, nil
+}
+
+// ruleKey names a rule by namespace, since namespaces may reuse rule names.
+func ruleKey(namespace, rule string) string {
+	return namespace + ":" + rule
+}
+
+func testRules(scan *scanner.Scanner, samples []ruleSample) *ruleTestReport {
+	loaded := make(map[string]bool)
+	byName := make(map[string][]string) // Rule name -> keys
+	for _, rule := range scan.Rules() {
+		key := ruleKey(rule.Namespace, rule.Name)
+		loaded[key] = true
+		byName[rule.Name] = append(byName[rule.Name], key)
+	}
+	// resolve turns a label into a rule key, or returns why it names no
+	// single rule. Rule names cannot contain a colon, namespaces can.
+	resolve := func(label string) (string, string) {
+		if strings.Contains(label, ":") {
+			if !loaded[label] {
+				return "", "rule not in the rule set"
+			}
+			return label, ""
+		}
+		switch keys := byName[label]; len(keys) {
+		case 0:
+			return "", "rule not in the rule set"
+		case 1:
+			return keys[0], ""
+		default:
+			return "", "rule is in several namespaces, label it " + strings.Join(keys, " or ")
+		}
+	}
+	results := make(map[string]*ruleResult)
+	result := func(rule string) *ruleResult {
+		if results[rule] == nil {
+			results[rule] = &ruleResult{Rule: rule}
+		}
+		return results[rule]
+	}
+
+	report := &ruleTestReport{Failures: make([]ruleFailure, 0)}
+	fail := func(file, rule, reason string) {
+		report.Failures = append(report.Failures, ruleFailure{File: file, Rule: rule, Reason: reason})
+	}
+
+	profile := scanner.NewProfile()
+	start := time.Now()
+	for _, sample := range samples {
+		content, err := os.ReadFile(sample.File)
+		if err != nil {
+			fail(sample.File, "", err.Error())
+			continue
+		}
+		path := sample.Path
+		if path == "" {
+			path = sample.File
+		}
+		matches, err := scan.ScanTarget(content, scanner.Target{Path: path, OwnerUID: -1, Event: "scan", Profile: profile})
+		if err != nil {
+			fail(sample.File, "", err.Error())
+			continue
+		}
+		report.Samples++
+
+		matched := make(map[string]bool)
+		for _, m := range matches {
+			matched[ruleKey(m.Namespace, m.Rule)] = true
+		}
+		for _, label := range sample.Match {
+			rule, reason := resolve(label)
+			switch {
+			case reason != "":
+				fail(sample.File, label, reason)
+			case matched[rule]:
+				result(rule).TruePositives++
+			default:
+				result(rule).FalseNegatives++
+				fail(sample.File, rule, "expected a match")
+			}
+		}
+		for _, label := range sample.NoMatch {
+			rule, reason := resolve(label)
+			switch {
+			case reason != "":
+				fail(sample.File, label, reason)
+			case matched[rule]:
+				result(rule).FalsePositives++
+				fail(sample.File, rule, "unexpected match")
+			default:
+				result(rule).TrueNegatives++
+			}
+		}
+		if sample.Clean {
+			for rule := range loaded {
+				if matched[rule] {
+					result(rule).FalsePositives++
+					fail(sample.File, rule, "unexpected match on a clean sample")
+				} else {
+					result(rule).TrueNegatives++
+				}
+			}
+		}
+	}
+	report.Duration = time.Since(start)
+
+	for _, cost := range profile.Costs() {
+		report.Profiled = true
+		if r := results[ruleKey(cost.Namespace, cost.Rule)]; r != nil {
+			r.Time += cost.Cost
+		}
+	}
+	report.Rules = make([]ruleResult, 0, len(results))
+	for _, r := range results {
+		report.Rules = append(report.Rules, *r)
+	}
+	sort.Slice(report.Rules, func(i, j int) bool { return report.Rules[i].Rule < report.Rules[j].Rule })
+	return report
+}
+
+func printRuleTestReport(report *ruleTestReport) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RULE\tTP\tFP\tTN\tFN\tTIME")
+	for _, r := range report.Rules {
+		spent := "-"
+		if report.Profiled {
+			spent = r.Time.String()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\n", r.Rule, r.TruePositives, r.FalsePositives, r.TrueNegatives, r.FalseNegatives, spent)
+	}
+	tw.Flush()
+
+	if len(report.Failures) > 0 {
+		fmt.Println()
+		tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "FAILED\tRULE\tSAMPLE")
+		for _, f := range report.Failures {
+			rule := f.Rule
+			if rule == "" {
+				rule = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Reason, rule, f.File)
+		}
+		tw.Flush()
+	}
+
+	fmt.Printf("\n%d samples in %s, %d failures\n", report.Samples, report.Duration.Round(time.Millisecond), len(report.Failures))
+	if !report.Profiled {
+		fmt.Println("Per-rule time needs libyara built with --enable-profiling")
+	}
+}
@@ -0,0 +1,263 @@
+package updater
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	ManifestFile  = "manifest.json"
+	SignatureFile = "manifest.json.sig"
+
+	maxManifestSize = 64 * 1024
+	maxBundleSize   = 64 << 20
+	maxExtractSize  = 256 << 20
+)
+
+var versionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Manifest describes a signed rule bundle. The signature covers the manifest
+// bytes, and the manifest pins the bundle by hash.
+type Manifest struct {
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	Bundle  string    `json:"bundle"` // File name of the .tar.gz next to the manifest
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Rules   int       `json:"rules,omitempty"`
+}
+
+func (m *Manifest) validate() error {
+	if !versionPattern.MatchString(m.Version) {
+		return fmt.Errorf("invalid bundle version %q", m.Version)
+	}
+	if m.Created.IsZero() {
+		return fmt.Errorf("manifest has no creation time")
+	}
+	if m.Bundle == "" || m.Bundle != filepath.Base(m.Bundle) || strings.HasPrefix(m.Bundle, ".") {
+		return fmt.Errorf("invalid bundle file name %q", m.Bundle)
+	}
+	if _, err := hex.DecodeString(m.SHA256); err != nil || len(m.SHA256) != 64 {
+		return fmt.Errorf("invalid bundle hash")
+	}
+	if m.Size <= 0 || m.Size > maxBundleSize {
+		return fmt.Errorf("invalid bundle size %d", m.Size)
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a hex ed25519 public key.
+func ParsePublicKey(value string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d hex-encoded bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// GenerateKey creates a signing key pair, hex encoded.
+func GenerateKey() (public, private string, err error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(pub), hex.EncodeToString(priv), nil
+}
+
+// ParsePrivateKey decodes a hex ed25519 private key.
+func ParsePrivateKey(value string) (ed25519.PrivateKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("private key must be %d hex-encoded bytes", ed25519.PrivateKeySize)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// verifyManifest checks the signature and returns the parsed manifest. The
+// signature file holds the base64 signature.
+func verifyManifest(key ed25519.PublicKey, manifest, signature []byte) (*Manifest, error) {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("malformed manifest signature")
+	}
+	if !ed25519.Verify(key, manifest, sig) {
+		return nil, fmt.Errorf("manifest signature does not match the configured public key")
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// extract unpacks the regular files of a .tar.gz into dir. Links, devices
+// and paths leaving dir are rejected.
+func extract(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("bundle is not gzip: %w", err)
+	}
+	defer gz.Close()
+
+	var total int64
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt bundle: %w", err)
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("bundle entry %q escapes the bundle", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			total += hdr.Size
+			if total > maxExtractSize {
+				return fmt.Errorf("bundle expands beyond %d bytes", maxExtractSize)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, io.LimitReader(tr, hdr.Size))
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("bundle entry %q is not a regular file or directory", hdr.Name)
+		}
+	}
+}
+
+// Build packs the rule files of dir into <version>.tar.gz in out and writes
+// the signed manifest next to it, ready to be served to agents.
+func Build(dir, out, version string, rules int, key ed25519.PrivateKey) (*Manifest, error) {
+	if !versionPattern.MatchString(version) {
+		return nil, fmt.Errorf("invalid bundle version %q", version)
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return nil, err
+	}
+
+	name := version + ".tar.gz"
+	archive := filepath.Join(out, name)
+	if err := pack(dir, archive); err != nil {
+		os.Remove(archive)
+		return nil, err
+	}
+	sum, size, err := hashFile(archive)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{Version: version, Created: time.Now().UTC(), Bundle: name, SHA256: sum, Size: size, Rules: rules}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	if err := os.WriteFile(filepath.Join(out, ManifestFile), data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(out, SignatureFile), []byte(sig+"\n"), 0644); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// pack writes every regular file below dir into a .tar.gz.
+func pack(dir, archive string) error {
+	f, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: filepath.ToSlash(rel), Mode: 0644, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(tw, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func hashFile(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
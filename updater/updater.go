@@ -0,0 +1,448 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"anti-abuse-go/config"
+	"anti-abuse-go/fleet"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/scanner"
+)
+
+const (
+	currentLink = "current"
+	pinFile     = "pinned"
+)
+
+// ErrDisabled is returned by the control commands when updates are off.
+var ErrDisabled = errors.New("signature updates are disabled")
+
+// Bundle is an installed bundle.
+type Bundle struct {
+	Manifest
+	Active bool `json:"active"`
+}
+
+// Updater fetches signed rule bundles, installs them side by side and
+// switches the "current" link to the newest one that compiles.
+type Updater struct {
+	source   string // Base URL ending in /
+	token    string // Bearer token when the source is the fleet server
+	client   *http.Client
+	key      ed25519.PublicKey
+	dir      string
+	keep     int
+	interval time.Duration
+	activate func() error // Reloads the scanner from ActivePath
+
+	mu   sync.Mutex // Serializes installs and rollbacks
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// ActivePath returns the rules directory the scanner should load: the
+// active bundle when updates are enabled and one is installed, otherwise
+// DETECTION.SignaturePath.
+func ActivePath(cfg *config.Config) string {
+	if cfg.Updates.Enabled {
+		if target, err := filepath.EvalSymlinks(filepath.Join(bundleDir(cfg), currentLink)); err == nil {
+			return target
+		}
+	}
+	return cfg.Detection.SignaturePath
+}
+
+func bundleDir(cfg *config.Config) string {
+	if cfg.Updates.Path != "" {
+		return cfg.Updates.Path
+	}
+	return "/var/lib/sentinel/bundles"
+}
+
+// New returns the updater for the config, or nil when updates are disabled.
+// activate is called after the current link changes and must reload the
+// scanner from ActivePath.
+func New(cfg *config.Config, activate func() error) (*Updater, error) {
+	if !cfg.Updates.Enabled {
+		return nil, nil
+	}
+	key, err := ParsePublicKey(cfg.Updates.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	client, err := fleet.HTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 5 * time.Minute
+
+	u := &Updater{
+		client:   client,
+		key:      key,
+		dir:      bundleDir(cfg),
+		keep:     3,
+		interval: time.Hour,
+		activate: activate,
+		stop:     make(chan struct{}),
+	}
+	if cfg.Updates.URL != "" {
+		u.source = strings.TrimSuffix(cfg.Updates.URL, "/") + "/"
+	} else {
+		u.source = strings.TrimSuffix(cfg.Fleet.ServerURL, "/") + "/api/v1/bundle/"
+		u.token = cfg.Fleet.Token
+	}
+	if cfg.Updates.Keep > 0 {
+		u.keep = cfg.Updates.Keep
+	}
+	if cfg.Updates.IntervalMinutes > 0 {
+		u.interval = time.Duration(cfg.Updates.IntervalMinutes) * time.Minute
+	}
+	if err := os.MkdirAll(u.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create bundle directory: %w", err)
+	}
+	return u, nil
+}
+
+// Start checks for a new bundle now and then on every interval.
+func (u *Updater) Start() {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+		for {
+			if _, _, err := u.Check(false); err != nil {
+				logger.Log.WithError(err).Warn("Signature update failed")
+			}
+			select {
+			case <-ticker.C:
+			case <-u.stop:
+				return
+			}
+		}
+	}()
+	logger.Log.Infof("Checking %s for signature bundles every %s", u.source, u.interval)
+}
+
+func (u *Updater) Stop() {
+	if u == nil {
+		return
+	}
+	close(u.stop)
+	u.wg.Wait()
+}
+
+// Check installs the published bundle if it is newer than the active one.
+// While a rollback pins the active bundle, only a forced check installs;
+// forcing also clears the pin. It returns the published manifest and
+// whether it was installed.
+func (u *Updater) Check(force bool) (*Manifest, bool, error) {
+	if u == nil {
+		return nil, false, ErrDisabled
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if force {
+		_ = os.Remove(filepath.Join(u.dir, pinFile))
+	} else if pinned, _ := os.ReadFile(filepath.Join(u.dir, pinFile)); len(pinned) > 0 {
+		logger.Log.Debugf("Signature bundle pinned to %s, skipping update", strings.TrimSpace(string(pinned)))
+		return nil, false, nil
+	}
+
+	manifestData, err := u.fetch(ManifestFile, maxManifestSize)
+	if err != nil {
+		return nil, false, err
+	}
+	sig, err := u.fetch(SignatureFile, 1024)
+	if err != nil {
+		return nil, false, err
+	}
+	m, err := verifyManifest(u.key, manifestData, sig)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if current := u.current(); current != nil {
+		if current.Version == m.Version {
+			return m, false, nil
+		}
+		// A replayed older manifest is still validly signed; never go back
+		if !m.Created.After(current.Created) {
+			logger.Log.Warnf("Ignoring signature bundle %s, it is older than the active %s", m.Version, current.Version)
+			return m, false, nil
+		}
+	}
+
+	if err := u.install(m, manifestData, sig); err != nil {
+		return m, false, fmt.Errorf("bundle %s rejected: %w", m.Version, err)
+	}
+	if err := u.switchTo(m.Version); err != nil {
+		return m, false, err
+	}
+	u.prune()
+	return m, true, nil
+}
+
+// install downloads, verifies, unpacks and test-compiles a bundle into its
+// own directory.
+func (u *Updater) install(m *Manifest, manifestData, sig []byte) error {
+	download, err := os.CreateTemp(u.dir, ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(download.Name())
+	defer download.Close()
+
+	if err := u.download(m, download); err != nil {
+		return err
+	}
+
+	staging := filepath.Join(u.dir, "."+m.Version+".tmp")
+	_ = os.RemoveAll(staging)
+	if err := os.MkdirAll(staging, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := extract(download.Name(), staging); err != nil {
+		return err
+	}
+	rules, err := scanner.CheckRules(staging)
+	if err != nil {
+		return fmt.Errorf("test compile failed: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(staging, ManifestFile), manifestData, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(staging, SignatureFile), sig, 0600); err != nil {
+		return err
+	}
+
+	target := filepath.Join(u.dir, m.Version)
+	_ = os.RemoveAll(target)
+	if err := os.Rename(staging, target); err != nil {
+		return err
+	}
+	logger.Log.Infof("Installed signature bundle %s (%d rules)", m.Version, rules)
+	return nil
+}
+
+// download fetches the bundle into f and checks its size and hash.
+func (u *Updater) download(m *Manifest, f *os.File) error {
+	resp, err := u.get(m.Bundle)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, m.Size+1))
+	if err != nil {
+		return fmt.Errorf("failed to download bundle: %w", err)
+	}
+	if n != m.Size {
+		return fmt.Errorf("bundle is %d bytes, manifest says %d", n, m.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, m.SHA256) {
+		return fmt.Errorf("bundle hash %s does not match the manifest", sum)
+	}
+	return f.Sync()
+}
+
+// switchTo points the current link at an installed version and reloads the
+// scanner, going back to the previous version if the reload fails.
+func (u *Updater) switchTo(version string) error {
+	previous, _ := os.Readlink(filepath.Join(u.dir, currentLink))
+	if err := u.link(version); err != nil {
+		return err
+	}
+	if err := u.activate(); err != nil {
+		if previous != "" {
+			if lerr := u.link(previous); lerr != nil {
+				logger.Log.WithError(lerr).Error("Failed to restore the previous signature bundle link")
+			} else if aerr := u.activate(); aerr != nil {
+				logger.Log.WithError(aerr).Error("Failed to reload the previous signature bundle")
+			}
+		}
+		return fmt.Errorf("failed to activate bundle %s: %w", version, err)
+	}
+	logger.Log.Infof("Signature bundle %s is active", version)
+	return nil
+}
+
+// link atomically replaces the current link.
+func (u *Updater) link(version string) error {
+	tmp := filepath.Join(u.dir, "."+currentLink+".tmp")
+	_ = os.Remove(tmp)
+	if err := os.Symlink(version, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(u.dir, currentLink))
+}
+
+// Rollback activates an installed bundle, the one installed before the
+// active one when version is empty, and pins it until the next forced check.
+func (u *Updater) Rollback(version string) (*Manifest, error) {
+	if u == nil {
+		return nil, ErrDisabled
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	bundles, err := u.list()
+	if err != nil {
+		return nil, err
+	}
+	var target *Bundle
+	for i := range bundles {
+		if version == "" && bundles[i].Active && i+1 < len(bundles) {
+			target = &bundles[i+1]
+			break
+		}
+		if version != "" && bundles[i].Version == version {
+			target = &bundles[i]
+			break
+		}
+	}
+	if target == nil {
+		if version == "" {
+			return nil, fmt.Errorf("no earlier bundle to roll back to")
+		}
+		return nil, fmt.Errorf("bundle %s is not installed", version)
+	}
+	if target.Active {
+		return nil, fmt.Errorf("bundle %s is already active", target.Version)
+	}
+
+	if err := u.switchTo(target.Version); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(u.dir, pinFile), []byte(target.Version+"\n"), 0600); err != nil {
+		logger.Log.WithError(err).Warn("Failed to pin signature bundle, the next check may update it")
+	}
+	return &target.Manifest, nil
+}
+
+// List returns the installed bundles, newest first.
+func (u *Updater) List() ([]Bundle, error) {
+	if u == nil {
+		return nil, ErrDisabled
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.list()
+}
+
+func (u *Updater) list() ([]Bundle, error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return nil, err
+	}
+	active, _ := os.Readlink(filepath.Join(u.dir, currentLink))
+
+	bundles := make([]Bundle, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() || !versionPattern.MatchString(entry.Name()) {
+			continue
+		}
+		m, err := readManifest(filepath.Join(u.dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		bundles = append(bundles, Bundle{Manifest: *m, Active: entry.Name() == active})
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].Created.After(bundles[j].Created) })
+	return bundles, nil
+}
+
+// prune removes all but the active bundle and the keep newest others.
+func (u *Updater) prune() {
+	bundles, err := u.list()
+	if err != nil {
+		return
+	}
+	kept := 0
+	for _, b := range bundles {
+		if b.Active {
+			continue
+		}
+		if kept < u.keep {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(u.dir, b.Version)); err != nil {
+			logger.Log.WithError(err).Warnf("Failed to remove old signature bundle %s", b.Version)
+			continue
+		}
+		logger.Log.Debugf("Removed old signature bundle %s", b.Version)
+	}
+}
+
+func (u *Updater) current() *Manifest {
+	m, err := readManifest(filepath.Join(u.dir, currentLink))
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+func readManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (u *Updater) fetch(name string, limit int64) ([]byte, error) {
+	resp, err := u.get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", name, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, limit)
+	}
+	return data, nil
+}
+
+func (u *Updater) get(name string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u.source+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %s: %s", name, resp.Status)
+	}
+	return resp, nil
+}
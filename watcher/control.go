@@ -0,0 +1,193 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"anti-abuse-go/integrations"
+	"anti-abuse-go/logger"
+	"anti-abuse-go/scanner"
+)
+
+const recentDetections = 100
+
+// Status is a snapshot of the watcher for the control socket.
+type Status struct {
+	Paused        bool      `json:"paused"`
+	Workers       int       `json:"workers"`
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+	AIQueueDepth  int       `json:"ai_queue_depth"`
+	WatchedDirs   int       `json:"watched_dirs"`
+	RulesLoaded   int       `json:"rules_loaded"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+func (w *Watcher) Status() Status {
+	w.watchedMu.Lock()
+	watched := len(w.watched)
+	w.watchedMu.Unlock()
+
+	status := Status{
+		Paused:        w.paused.Load(),
+		Workers:       w.workerPool,
+		QueueDepth:    len(w.workChan),
+		QueueCapacity: cap(w.workChan),
+		WatchedDirs:   watched,
+		RulesLoaded:   w.scanner.RuleCount(),
+		LastHeartbeat: w.LastHeartbeat(),
+	}
+	if ai := w.aiStage(); ai != nil {
+		status.AIQueueDepth = ai.QueueDepth()
+	}
+	return status
+}
+
+// LastHeartbeat returns when the event loop last ticked. The loop ticks
+// every second, so an old heartbeat means it is stuck.
+func (w *Watcher) LastHeartbeat() time.Time {
+	return time.Unix(0, w.heartbeat.Load())
+}
+
+// Pause stops processing file events until Resume. Events that arrive in
+// between are dropped; queued events are still processed.
+func (w *Watcher) Pause() {
+	w.paused.Store(true)
+	logger.Log.Info("Watching paused")
+}
+
+func (w *Watcher) Resume() {
+	w.paused.Store(false)
+	logger.Log.Info("Watching resumed")
+}
+
+// ScanResult is a flagged file found by an on-demand scan.
+type ScanResult struct {
+	Path    string             `json:"path"`
+	Matches scanner.MatchRules `json:"matches"`
+}
+
+// ScanReport summarizes an on-demand scan.
+type ScanReport struct {
+	Files   int          `json:"files"`
+	Errors  int          `json:"errors"`
+	Flagged []ScanResult `json:"flagged"`
+}
+
+// ScanPath scans a file or directory tree now. Flagged files go through the
+// same decision and alerting as watched events.
+func (w *Watcher) ScanPath(root string) (*ScanReport, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	report := &ScanReport{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+		if err != nil {
+			report.Errors++
+			return nil
+		}
+		if info.IsDir() {
+			if path != root && w.shouldIgnore(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || w.shouldIgnore(path) {
+			return nil
+		}
+
+		content, owner, err := w.readFileContent(path)
+		if err != nil {
+			report.Errors++
+			return nil
+		}
+		report.Files++
+
+		matches, err := w.scan(content, w.target(path, "scan", owner))
+		if err != nil {
+			report.Errors++
+			return nil
+		}
+		if len(matches) > 0 {
+			logger.Log.WithField("matches", len(matches)).Infof("Flagged by on-demand scan: %s", path)
+			report.Flagged = append(report.Flagged, ScanResult{Path: path, Matches: matches})
+			w.queueDetection(integrations.NewDetection(w.cfg(), path, content, matches), content)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// StartScan scans a file or directory below a watched root in the
+// background, like ScanPath, and returns the path with symlinks resolved.
+// Other paths are refused so remote callers cannot have root read
+// arbitrary files.
+func (w *Watcher) StartScan(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		return "", err
+	}
+	watched := false
+	for _, root := range w.cfg().Detection.WatchdogPath {
+		root, err := filepath.EvalSymlinks(filepath.Clean(root))
+		if err == nil && (resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator))) {
+			watched = true
+			break
+		}
+	}
+	if !watched {
+		return "", fmt.Errorf("%s is not below a watched path", path)
+	}
+
+	w.scansMu.Lock()
+	defer w.scansMu.Unlock()
+	if w.scans[resolved] {
+		return "", fmt.Errorf("a scan of %s is already running", resolved)
+	}
+	w.scans[resolved] = true
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		report, err := w.ScanPath(resolved)
+		w.scansMu.Lock()
+		delete(w.scans, resolved)
+		w.scansMu.Unlock()
+		if err != nil {
+			logger.Log.WithError(err).Warnf("Background scan of %s failed", resolved)
+			return
+		}
+		logger.Log.Infof("Background scan of %s done: %d files, %d flagged, %d errors", resolved, report.Files, len(report.Flagged), report.Errors)
+	}()
+	return resolved, nil
+}
+
+func (w *Watcher) recordRecent(d integrations.Detection) {
+	w.recentMu.Lock()
+	defer w.recentMu.Unlock()
+	w.recent = append(w.recent, d)
+	if len(w.recent) > recentDetections {
+		w.recent = w.recent[len(w.recent)-recentDetections:]
+	}
+}
+
+// RecentDetections returns up to n of the latest decided detections, newest first.
+func (w *Watcher) RecentDetections(n int) []integrations.Detection {
+	w.recentMu.Lock()
+	defer w.recentMu.Unlock()
+	if n <= 0 || n > len(w.recent) {
+		n = len(w.recent)
+	}
+	out := make([]integrations.Detection, 0, n)
+	for i := len(w.recent) - 1; i >= 0 && len(out) < n; i-- {
+		out = append(out, w.recent[i])
+	}
+	return out
+}
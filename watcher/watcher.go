@@ -6,13 +6,21 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"anti-abuse-go/config"
+	"anti-abuse-go/decision"
+	"anti-abuse-go/fleet"
+	"anti-abuse-go/history"
 	"anti-abuse-go/integrations"
 	"anti-abuse-go/logger"
+	"anti-abuse-go/metrics"
 	"anti-abuse-go/plugins"
+	"anti-abuse-go/quarantine"
 	"anti-abuse-go/scanner"
 	"github.com/fsnotify/fsnotify"
 )
@@ -21,6 +29,10 @@ type Watcher struct {
 	watcher       *fsnotify.Watcher
 	scanner       *scanner.Scanner
 	config        *config.Config
+	alerts        *integrations.Aggregator
+	ai            *integrations.AIStage // nil when AI is disabled
+	retiredAI     sync.WaitGroup        // Stages replaced on reload that are still stopping
+	decisions     *decision.Engine
 	workChan      chan FileEvent
 	workerPool    int
 	bufferSize    int
@@ -29,12 +41,22 @@ type Watcher struct {
 	wg            sync.WaitGroup
 	processedFiles map[string]time.Time // Deduplication map
 	processedMu   sync.RWMutex         // Mutex for deduplication map
+	mu            sync.RWMutex         // Guards config, ai and decisions, which are swapped on reload
+	watched       map[string]bool      // Directories added to the fsnotify watcher
+	watchedMu     sync.Mutex
+	paused        atomic.Bool
+	heartbeat     atomic.Int64 // Unix nanoseconds of the last event loop tick
+	recent        []integrations.Detection // Latest decided detections, oldest first
+	recentMu      sync.Mutex
+	scans         map[string]bool // Background scans in progress, by resolved path
+	scansMu       sync.Mutex
 }
 
+// FileEvent is a changed file waiting for a worker, which reads it so that
+// large files don't hold up the event loop.
 type FileEvent struct {
-	Path    string
-	Op      fsnotify.Op
-	Content []byte
+	Path string
+	Op   fsnotify.Op
 }
 
 func NewWatcher(cfg *config.Config, scan *scanner.Scanner) (*Watcher, error) {
@@ -43,6 +65,12 @@ func NewWatcher(cfg *config.Config, scan *scanner.Scanner) (*Watcher, error) {
 		return nil, fmt.Errorf("failed to create file system watcher: %w", err)
 	}
 
+	decisions, err := decision.NewEngine(cfg)
+	if err != nil {
+		w.Close()
+		return nil, fmt.Errorf("invalid decision config: %w", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Auto-tune based on system resources
@@ -52,12 +80,19 @@ func NewWatcher(cfg *config.Config, scan *scanner.Scanner) (*Watcher, error) {
 		watcher:        w,
 		scanner:        scan,
 		config:         cfg,
+		alerts:         integrations.NewAggregator(cfg),
+		decisions:      decisions,
 		workChan:       make(chan FileEvent, bufferSize),
 		workerPool:     workerPool,
 		bufferSize:     bufferSize,
 		ctx:            ctx,
 		cancel:         cancel,
 		processedFiles: make(map[string]time.Time),
+		watched:        make(map[string]bool),
+		scans:          make(map[string]bool),
+	}
+	if cfg.Integration.AI.Enabled {
+		watch.ai = integrations.NewAIStage(cfg)
 	}
 
 	return watch, nil
@@ -106,7 +141,7 @@ func (w *Watcher) Start() error {
 	}
 
 	// Add watch paths
-	for _, path := range w.config.Detection.WatchdogPath {
+	for _, path := range w.cfg().Detection.WatchdogPath {
 		if err := w.addWatchRecursive(path); err != nil {
 			logger.Log.WithError(err).Warnf("Failed to watch path: %s", path)
 		}
@@ -118,10 +153,16 @@ func (w *Watcher) Start() error {
 		go w.worker(i)
 	}
 
+	w.alerts.Start()
+	if ai := w.aiStage(); ai != nil {
+		ai.Start()
+	}
+
 	// Start deduplication cleanup goroutine
 	go w.cleanupProcessedFiles()
 
 	// Start event loop
+	w.heartbeat.Store(time.Now().UnixNano())
 	go w.eventLoop()
 
 	logger.Log.Infof("Watcher started with %d workers", w.workerPool)
@@ -133,9 +174,108 @@ func (w *Watcher) Stop() {
 	w.watcher.Close()
 	close(w.workChan)
 	w.wg.Wait()
+	// Pending verdicts still feed the aggregator, so it is stopped last,
+	// after the stages retired by reloads
+	if ai := w.aiStage(); ai != nil {
+		ai.Stop()
+	}
+	w.retiredAI.Wait()
+	w.alerts.Stop()
 	logger.Log.Info("Watcher stopped")
 }
 
+func (w *Watcher) cfg() *config.Config {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.config
+}
+
+func (w *Watcher) aiStage() *integrations.AIStage {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.ai
+}
+
+// Reload applies a new configuration without dropping queued events: watched
+// roots are added and removed, ignore lists and the size limit apply to the
+// next event, and alerting, AI and decision settings are swapped in place.
+// Nothing is changed when the new configuration is rejected.
+func (w *Watcher) Reload(cfg *config.Config) error {
+	decisions, err := decision.NewEngine(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid decision config: %w", err)
+	}
+
+	w.mu.Lock()
+	w.config = cfg
+	w.decisions = decisions
+	switch {
+	case !cfg.Integration.AI.Enabled && w.ai != nil:
+		w.retireAI(w.ai)
+		w.ai = nil
+	case cfg.Integration.AI.Enabled && w.ai == nil:
+		w.ai = integrations.NewAIStage(cfg)
+		w.ai.Start()
+	case cfg.Integration.AI.Enabled:
+		old := w.ai
+		w.ai = w.ai.Reload(cfg)
+		w.retireAI(old)
+	}
+	w.mu.Unlock()
+
+	w.alerts.Reload(cfg)
+	w.updateWatches(cfg)
+	return nil
+}
+
+// retireAI stops a replaced AI stage in the background. Stop waits for it.
+func (w *Watcher) retireAI(ai *integrations.AIStage) {
+	w.retiredAI.Add(1)
+	go func() {
+		defer w.retiredAI.Done()
+		ai.Stop()
+	}()
+}
+
+// updateWatches watches new roots and newly unignored directories, and stops
+// watching directories that are outside every root or now ignored.
+func (w *Watcher) updateWatches(cfg *config.Config) {
+	w.watchedMu.Lock()
+	var stale []string
+	for dir := range w.watched {
+		if !underAny(dir, cfg.Detection.WatchdogPath) || w.shouldIgnore(dir) {
+			stale = append(stale, dir)
+			delete(w.watched, dir)
+		}
+	}
+	w.watchedMu.Unlock()
+
+	for _, dir := range stale {
+		if err := w.watcher.Remove(dir); err != nil {
+			logger.Log.WithError(err).Debugf("Failed to unwatch directory: %s", dir)
+		}
+	}
+	if len(stale) > 0 {
+		logger.Log.Infof("Stopped watching %d directories", len(stale))
+	}
+
+	for _, root := range cfg.Detection.WatchdogPath {
+		if err := w.addWatchRecursive(root); err != nil {
+			logger.Log.WithError(err).Warnf("Failed to watch path: %s", root)
+		}
+	}
+}
+
+func underAny(dir string, roots []string) bool {
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *Watcher) addWatchRecursive(root string) error {
 	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -147,6 +287,9 @@ func (w *Watcher) addWatchRecursive(root string) error {
 				logger.Log.WithError(err).Warnf("Failed to watch directory: %s", path)
 				// Don't return error - continue trying other directories
 			} else {
+				w.watchedMu.Lock()
+				w.watched[filepath.Clean(path)] = true
+				w.watchedMu.Unlock()
 				logger.Log.Debugf("Watching directory: %s", path)
 			}
 		}
@@ -155,7 +298,7 @@ func (w *Watcher) addWatchRecursive(root string) error {
 }
 
 func (w *Watcher) shouldIgnore(path string) bool {
-	for _, ignore := range w.config.Detection.WatchdogIgnorePath {
+	for _, ignore := range w.cfg().Detection.WatchdogIgnorePath {
 		if matched, _ := filepath.Match(ignore, path); matched {
 			return true
 		}
@@ -175,10 +318,12 @@ func (w *Watcher) eventLoop() {
 			if !ok {
 				return
 			}
-			if w.shouldProcessEvent(event) {
+			metrics.EventsReceived.Inc(strings.ToLower(event.Op.String()))
+			if !w.paused.Load() && w.shouldProcessEvent(event) {
 				events = append(events, event)
 			}
 		case <-ticker.C:
+			w.heartbeat.Store(time.Now().UnixNano())
 			w.processBatch(events)
 			events = nil
 		case err, ok := <-w.watcher.Errors:
@@ -196,7 +341,7 @@ func (w *Watcher) shouldProcessEvent(event fsnotify.Event) bool {
 	if w.shouldIgnore(event.Name) {
 		return false
 	}
-	for _, ignore := range w.config.Detection.WatchdogIgnoreFile {
+	for _, ignore := range w.cfg().Detection.WatchdogIgnoreFile {
 		if matched, _ := filepath.Match(ignore, filepath.Base(event.Name)); matched {
 			return false
 		}
@@ -206,17 +351,12 @@ func (w *Watcher) shouldProcessEvent(event fsnotify.Event) bool {
 
 func (w *Watcher) processBatch(events []fsnotify.Event) {
 	for _, event := range events {
-		content, err := w.readFileContent(event.Name)
-		if err != nil {
-			logger.Log.WithError(err).Debugf("Failed to read file: %s", event.Name)
-			continue
-		}
-
 		select {
-		case w.workChan <- FileEvent{Path: event.Name, Op: event.Op, Content: content}:
+		case w.workChan <- FileEvent{Path: event.Name, Op: event.Op}:
 		case <-w.ctx.Done():
 			return
 		default:
+			metrics.EventsDropped.Inc()
 			logger.Log.Warn("Work channel full, dropping event")
 		}
 	}
@@ -243,30 +383,32 @@ func (w *Watcher) cleanupProcessedFiles() {
 	}
 }
 
-func (w *Watcher) readFileContent(path string) ([]byte, error) {
+// readFileContent reads a file within the size limit and returns it with
+// the UID of its owner.
+func (w *Watcher) readFileContent(path string) ([]byte, int, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		return nil, err
+		return nil, -1, err
 	}
-
-	maxSize := int64(100 * 1024 * 1024) // Default 100MB
-	if w.config.Detection.MaxFileSizeMB > 0 {
-		maxSize = int64(w.config.Detection.MaxFileSizeMB) * 1024 * 1024
+	owner := -1
+	if sys, ok := stat.Sys().(*syscall.Stat_t); ok {
+		owner = int(sys.Uid)
 	}
 
+	maxSize := w.scanner.ScanProfileFor(path).MaxFileSize
 	if stat.Size() > maxSize {
-		return nil, fmt.Errorf("file too large: %d bytes (max %d)", stat.Size(), maxSize)
+		return nil, -1, fmt.Errorf("file too large: %d bytes (max %d)", stat.Size(), maxSize)
 	}
 
 	buf := make([]byte, stat.Size())
 	_, err = file.Read(buf)
-	return buf, err
+	return buf, owner, err
 }
 
 func (w *Watcher) worker(id int) {
@@ -298,7 +440,13 @@ func (w *Watcher) processFile(event FileEvent) {
 	w.processedFiles[event.Path] = time.Now()
 	w.processedMu.Unlock()
 
-	matches, err := w.scanner.Scan(event.Content, event.Path)
+	content, owner, err := w.readFileContent(event.Path)
+	if err != nil {
+		logger.Log.WithError(err).Debugf("Failed to read file: %s", event.Path)
+		return
+	}
+
+	matches, err := w.scan(content, w.target(event.Path, eventType(event.Op), owner))
 	if err != nil {
 		logger.Log.WithError(err).Debugf("Scan failed for %s", event.Path)
 		return
@@ -307,40 +455,195 @@ func (w *Watcher) processFile(event FileEvent) {
 	if len(matches) > 0 {
 		logger.Log.WithField("matches", len(matches)).Infof("Flagged: %s", event.Path)
 
-		// Trigger AI analysis if enabled
-		var aiAnalysis string
-		if w.config.Integration.AI.Enabled {
-			analysis, err := integrations.AnalyzeWithAI(w.config, string(event.Content))
-			if err != nil {
-				logger.Log.WithError(err).Warnf("AI analysis failed for %s", event.Path)
-				aiAnalysis = "AI analysis failed"
-			} else if analysis != nil {
-				aiAnalysis = analysis.Content
-			}
+		// Decide and queue for the aggregated alert of this server
+		detection := integrations.NewDetection(w.cfg(), event.Path, content, matches)
+		w.queueDetection(detection, content)
+	} else if cfg := w.cfg(); cfg.Logs.FileModified || cfg.Logs.FileCreated {
+		logger.Log.Debugf("Processed: %s", event.Path)
+	}
+}
+
+// target describes a file to the rules.
+func (w *Watcher) target(path, event string, owner int) scanner.Target {
+	target := scanner.Target{Path: path, OwnerUID: owner, Event: event}
+	for _, root := range w.cfg().Detection.WatchdogPath {
+		root = filepath.Clean(root)
+		if (path == root || strings.HasPrefix(path, root+string(filepath.Separator))) && len(root) > len(target.WatchRoot) {
+			target.WatchRoot = root
 		}
+	}
+	return target
+}
 
-		// Send Discord webhook if enabled
-		if w.config.Integration.Discord.Enabled {
-			fields := make([]integrations.DiscordField, 0)
-			for _, match := range matches {
-				fields = append(fields, integrations.DiscordField{
-					Name:   match.Rule,
-					Value:  match.Tags,
-					Inline: true,
-				})
-			}
-			if err := integrations.SendDiscordWebhook(w.config, w.config.MachineID, event.Path, fields, aiAnalysis); err != nil {
-				logger.Log.WithError(err).Warnf("Discord webhook failed for %s", event.Path)
-			}
+// eventType names a file event for the event_type rule variable.
+func eventType(op fsnotify.Op) string {
+	switch {
+	case op&fsnotify.Create != 0:
+		return "create"
+	case op&fsnotify.Write != 0:
+		return "write"
+	case op&fsnotify.Rename != 0:
+		return "rename"
+	case op&fsnotify.Remove != 0:
+		return "remove"
+	default:
+		return strings.ToLower(op.String())
+	}
+}
+
+// scan runs YARA over a file and records scan metrics.
+func (w *Watcher) scan(content []byte, target scanner.Target) (scanner.MatchRules, error) {
+	start := time.Now()
+	matches, err := w.scanner.ScanTarget(content, target)
+	metrics.ScanDuration.Observe(time.Since(start).Seconds())
+	metrics.FilesScanned.Inc()
+	metrics.BytesScanned.Add(float64(len(content)))
+	for _, match := range matches {
+		metrics.Detections.Inc(match.Rule)
+	}
+	return matches, err
+}
+
+// queueDetection hands a detection to the aggregator, running AI analysis in
+// the background when enabled. In follow-up mode the alert goes out right
+// away, unless the YARA matches alone are ignored, and the verdict follows;
+// in wait mode the alert waits for the verdict. Plugins act once the
+// decision, including any AI verdict, is final.
+func (w *Watcher) queueDetection(detection integrations.Detection, content []byte) {
+	ai := w.aiStage()
+	if ai == nil || w.scanner.ScanProfileFor(detection.Path).DisableAI {
+		w.decide(&detection, nil)
+		return
+	}
+
+	wait := integrations.AIAlertMode(w.cfg()) == integrations.AIAlertWait
+	alerted := false
+	if !wait && w.verdict(&detection, nil).Action != decision.ActionIgnore {
+		w.alerts.Add(detection)
+		alerted = true
+	}
+
+	err := ai.Submit(integrations.AIRequest{
+		FilePath: detection.Path,
+		Content:  content,
+		Matches:  detection.Matches,
+	}, func(analysis *integrations.AIAnalysis, err error) {
+		if err != nil {
+			logger.Log.WithError(err).Warnf("AI analysis failed for %s", detection.Path)
+			detection.AIAnalysis = "AI analysis failed"
+			analysis = nil
+		} else if analysis != nil {
+			detection.AIAnalysis = analysis.Summary()
+		}
+		if alerted {
+			w.decideFollowUp(&detection, analysis)
+		} else {
+			w.decide(&detection, analysis)
+		}
+	})
+	if err != nil {
+		logger.Log.WithError(err).Warnf("AI analysis skipped for %s", detection.Path)
+		detection.AIAnalysis = fmt.Sprintf("AI analysis skipped: %v", err)
+		if alerted {
+			w.decideFollowUp(&detection, nil)
+		} else {
+			w.decide(&detection, nil)
 		}
+	}
+}
 
-		// Trigger plugins
-		for _, plugin := range plugins.GetPlugins() {
-			if err := plugin.OnDetected(event.Path, matches); err != nil {
-				logger.Log.WithError(err).Warnf("Plugin %s failed for %s", plugin.Name(), event.Path)
-			}
+// decide runs the decision engine and plugins for a detection and queues its
+// alert unless the verdict is to ignore it.
+func (w *Watcher) decide(detection *integrations.Detection, analysis *integrations.AIAnalysis) {
+	verdict, actions := w.enforce(detection, analysis)
+	if verdict.Action != decision.ActionIgnore {
+		w.alerts.Add(*detection)
+		actions = append(actions, "alert")
+	}
+	w.recordHistory(detection, analysis, actions)
+}
+
+// decideFollowUp is decide for detections that were already alerted; the
+// verdict goes out as a follow-up unless it is to ignore the detection.
+func (w *Watcher) decideFollowUp(detection *integrations.Detection, analysis *integrations.AIAnalysis) {
+	verdict, actions := w.enforce(detection, analysis)
+	if verdict.Action != decision.ActionIgnore {
+		w.alerts.AddFollowUp(*detection)
+	}
+	w.recordHistory(detection, analysis, append(actions, "alert"))
+}
+
+// verdict runs the decision engine without acting on the result.
+func (w *Watcher) verdict(detection *integrations.Detection, analysis *integrations.AIAnalysis) *decision.Verdict {
+	input := decision.Input{SHA256: detection.SHA256, Matches: detection.Matches}
+	if analysis != nil {
+		input.AI = &decision.AIInput{Score: analysis.Score, Confidence: analysis.Confidence}
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.decisions.Decide(input)
+}
+
+// enforce decides a detection and carries out the verdict. It returns the
+// actions taken for the history.
+func (w *Watcher) enforce(detection *integrations.Detection, analysis *integrations.AIAnalysis) (*decision.Verdict, []string) {
+	verdict := w.verdict(detection, analysis)
+	detection.Verdict = verdict
+	logger.Log.Infof("Decision for %s: %s", detection.Path, verdict.Summary())
+
+	var actions []string
+	if verdict.Action == decision.ActionQuarantine {
+		if item, err := quarantine.File(detection.Path, verdict.Summary(), detection.SHA256); err != nil {
+			logger.Log.WithError(err).Errorf("Failed to quarantine %s", detection.Path)
+			actions = append(actions, "quarantine:failed")
+		} else {
+			actions = append(actions, "quarantine:"+item.ID)
+		}
+	}
+	w.recordRecent(*detection)
+
+	for _, plugin := range plugins.GetPlugins() {
+		if err := plugin.OnDetected(detection.Path, verdict); err != nil {
+			metrics.PluginActions.Inc(plugin.Name(), "error")
+			logger.Log.WithError(err).Warnf("Plugin %s failed for %s", plugin.Name(), detection.Path)
+			actions = append(actions, "plugin:"+plugin.Name()+":error")
+		} else {
+			metrics.PluginActions.Inc(plugin.Name(), "ok")
+			actions = append(actions, "plugin:"+plugin.Name())
+		}
+	}
+	return verdict, actions
+}
+
+// recordHistory appends a decided detection to the detection history.
+func (w *Watcher) recordHistory(detection *integrations.Detection, analysis *integrations.AIAnalysis, actions []string) {
+	rec := &history.Record{
+		Time:       detection.Time,
+		MachineID:  w.cfg().MachineID,
+		Path:       detection.Path,
+		ServerUUID: detection.ServerUUID,
+		Size:       detection.Size,
+		MD5:        detection.MD5,
+		SHA1:       detection.SHA1,
+		SHA256:     detection.SHA256,
+		Actions:    actions,
+	}
+	for _, m := range detection.Matches {
+		rec.Matches = append(rec.Matches, history.Match{Rule: m.Rule, Tags: m.Tags, Severity: m.Severity, Member: m.Member})
+	}
+	if v := detection.Verdict; v != nil {
+		rec.Action, rec.Rule, rec.Severity = v.Action, v.Rule, v.Severity
+	}
+	if analysis != nil {
+		rec.AI = &history.AI{
+			Score:      analysis.Score,
+			Confidence: analysis.Confidence,
+			Category:   analysis.Category,
+			Reason:     analysis.Reason,
+			Provider:   analysis.Provider,
+			Model:      analysis.Model,
 		}
-	} else if w.config.Logs.FileModified || w.config.Logs.FileCreated {
-		logger.Log.Debugf("Processed: %s", event.Path)
 	}
+	history.Add(rec)
+	fleet.Send(rec)
 }